@@ -1,10 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
+	"unicode/utf8"
 	"unsafe"
 )
 
@@ -18,6 +31,10 @@ func floatHttpRequest(
 	urlPtr, urlLen, methodPtr, methodLen, bodyPtr, bodyLen uint32,
 ) uint32
 
+// Copies up to resultLen bytes of the file into the buffer and returns the
+// file's full length, which may exceed resultLen, or floatReadFailed when
+// the path is rejected or unreadable
+//
 //go:wasmimport env float_read_file
 func floatReadFile(pathPtr, pathLen, resultPtr, resultLen uint32) uint32
 
@@ -39,6 +56,173 @@ type OllamaInput struct {
 	KeepAlive string                 `json:"keep_alive,omitempty"`
 	Images    []string               `json:"images,omitempty"`
 	OllamaURL string                 `json:"ollama_url"`
+
+	// Servers tried in order when one cannot be reached; without it
+	// ollama_url may hold a comma-separated list instead
+	OllamaURLs []string `json:"ollama_urls,omitempty"`
+
+	// Stop sequences merged into options.stop
+	Stop []string `json:"stop,omitempty"`
+
+	// Distributed tracing: either a full W3C traceparent or a trace/span pair
+	TraceParent string `json:"traceparent,omitempty"`
+	TraceID     string `json:"trace_id,omitempty"`
+	SpanID      string `json:"span_id,omitempty"`
+
+	// Encoding of the response text in the output: "utf8" (default) or "base64"
+	ResponseEncoding string `json:"response_encoding,omitempty"`
+
+	// Validate and assemble the request, then return it in metadata
+	// instead of sending it
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Path of the generate endpoint, for proxies that mount it elsewhere
+	// (default "/api/generate")
+	APIPath string `json:"api_path,omitempty"`
+
+	// Band of acceptable response/prompt ratios before flagging the output
+	MinResponseRatio float64 `json:"min_response_ratio,omitempty"`
+	MaxResponseRatio float64 `json:"max_response_ratio,omitempty"`
+
+	// Input/output pairs formatted into the prompt ahead of the query
+	FewShotExamples []FewShotExample `json:"few_shot_examples,omitempty"`
+
+	// Largest accepted image width or height in pixels (default 8192),
+	// number of images (default 10) and decoded size per image (default 20MiB)
+	MaxImageDimension int `json:"max_image_dimension,omitempty"`
+	MaxImages         int `json:"max_images,omitempty"`
+	MaxImageBytes     int `json:"max_image_bytes,omitempty"`
+
+	// Client-generated key for the request, validated and echoed in
+	// metadata so callers can deduplicate retried requests
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// Correlation id included in every log line and echoed in metadata;
+	// generated when unset
+	RequestID string `json:"request_id,omitempty"`
+
+	// Text returned in place of an error when generation fails
+	FallbackResponse string `json:"fallback_response,omitempty"`
+
+	// Weighted prompts blended into the prompt: "concatenate" (default) or "meta"
+	Prompts        []WeightedPrompt `json:"prompts,omitempty"`
+	BlendStrategy  string           `json:"blend_strategy,omitempty"`
+	BlendSeparator string           `json:"blend_separator,omitempty"`
+
+	// Values substituted for {{key}} tokens in Prompt and System; tokens
+	// left unreplaced are rejected
+	TemplateVars map[string]string `json:"template_vars,omitempty"`
+
+	// Case-insensitive terms rejected in the prompt and redacted or flagged
+	// in the response, per FilterMode ("redact" default, or "flag")
+	BlockedTerms []string `json:"blocked_terms,omitempty"`
+	FilterMode   string   `json:"filter_mode,omitempty"`
+
+	// Regex the response must match; mismatches are retried up to
+	// PatternMaxRetries times (default 2), optionally raising the
+	// temperature or adding a corrective instruction
+	ExpectedPattern        string  `json:"expected_pattern,omitempty"`
+	PatternMaxRetries      *int    `json:"pattern_max_retries,omitempty"`
+	PatternTemperatureStep float64 `json:"pattern_temperature_step,omitempty"`
+	PatternCorrection      bool    `json:"pattern_correction,omitempty"`
+
+	// Compact schema: field name to type ("string", "int", "number", "bool",
+	// optionally with "[]" for arrays and "!" for required), expanded into
+	// a JSON schema for Format
+	FormatFields map[string]string `json:"format_fields,omitempty"`
+
+	// Request JSON output: format defaults to "json", the system prompt is
+	// told to answer in JSON, and a response that does not parse is retried
+	// once with a stricter reminder
+	ForceJSON bool `json:"force_json,omitempty"`
+
+	// Dot path such as "answer.value" whose value in a JSON response is
+	// copied to metadata.extracted_value; numeric segments index arrays
+	ExtractPath string `json:"extract_path,omitempty"`
+
+	// Retry empty or whitespace-only responses up to EmptyMaxRetries times
+	// (default 2), raising a set num_predict by EmptyNumPredictStep each time
+	RetryOnEmpty        bool `json:"retry_on_empty,omitempty"`
+	EmptyMaxRetries     *int `json:"empty_max_retries,omitempty"`
+	EmptyNumPredictStep int  `json:"empty_num_predict_step,omitempty"`
+
+	// File receiving one JSON event per lifecycle stage
+	EventLogPath string `json:"event_log_path,omitempty"`
+
+	// Check via /api/show that the model is installed before generating
+	PreflightCheck bool `json:"preflight_check,omitempty"`
+
+	// JSON file mapping friendly names such as "fast" to model names; a
+	// model that is not an alias must be installed on the server
+	AliasFile string `json:"alias_file,omitempty"`
+
+	// Copy the response body into metadata.raw_response on success,
+	// truncated to MaxRawResponseBytes (default 64KiB)
+	IncludeRawResponse  bool `json:"include_raw_response,omitempty"`
+	MaxRawResponseBytes int  `json:"max_raw_response_bytes,omitempty"`
+
+	// Files to look for the HTTP response body in, tried in order, for
+	// runtimes that do not write it to http_response.json
+	ResponsePaths []string `json:"response_paths,omitempty"`
+
+	// File receiving the streamed text, written once after the stream is
+	// decoded; output.json is written as usual
+	StreamOutputPath string `json:"stream_output_path,omitempty"`
+
+	// Malformed stream chunks skipped before the stream fails (default 3)
+	MaxBadChunks *int `json:"max_bad_chunks,omitempty"`
+
+	// File an external controller creates containing "cancel" to abort a
+	// streaming generation; checked once, before the request is sent
+	CancelPath string `json:"cancel_path,omitempty"`
+
+	// Minimum level of emitted log lines: "debug", "info" (default) or
+	// "error"; request and response bodies are only logged in full at debug
+	LogLevel string `json:"log_level,omitempty"`
+
+	// Log the output as a single JSON line instead of writing output.json,
+	// leaving the return code and log as the only result
+	SkipOutputFile bool `json:"skip_output_file,omitempty"`
+
+	// Retries of connection-level HTTP failures, waiting
+	// RetryBackoffMs * 2^attempt (default 500ms, at most 30s) before each
+	MaxRetries     int `json:"max_retries,omitempty"`
+	RetryBackoffMs int `json:"retry_backoff_ms,omitempty"`
+
+	// Set once Prompts have been blended into Prompt, TemplateVars
+	// substituted, FormatFields expanded into Format and the model alias
+	// resolved
+	promptsBlended        bool
+	ollamaURLs            []string
+	templateApplied       bool
+	templateSubstitutions int
+	formatExpanded        bool
+	jsonForced            bool
+	aliasResolved         bool
+	modelAlias            string
+	modelChecked          bool
+
+	// Parsed keep_alive, the preflight /api/show result with the server it
+	// came from and the lifecycle event log of this invocation
+	keepAliveSeconds float64
+	preflightInfo    *ShowModelAPIResponse
+	preflightURL     string
+	events           *eventLog
+}
+
+// A prompt with its relative weight (default 1)
+type WeightedPrompt struct {
+	Text   string   `json:"text"`
+	Weight *float64 `json:"weight,omitempty"`
+}
+
+// Return code for a fallback response, distinct from success (0) and error (1)
+const fallbackReturnCode = 2
+
+// A single few-shot example
+type FewShotExample struct {
+	Input  string `json:"input"`
+	Output string `json:"output"`
 }
 
 // Output structure for Ollama response
@@ -48,6 +232,7 @@ type OllamaOutput struct {
 	Model              string                 `json:"model,omitempty"`
 	CreatedAt          string                 `json:"created_at,omitempty"`
 	Done               bool                   `json:"done"`
+	DoneReason         string                 `json:"done_reason,omitempty"`
 	Context            []int                  `json:"context,omitempty"`
 	TotalDuration      int64                  `json:"total_duration,omitempty"`
 	LoadDuration       int64                  `json:"load_duration,omitempty"`
@@ -55,11 +240,31 @@ type OllamaOutput struct {
 	PromptEvalDuration int64                  `json:"prompt_eval_duration,omitempty"`
 	EvalCount          int                    `json:"eval_count,omitempty"`
 	EvalDuration       int64                  `json:"eval_duration,omitempty"`
+	TotalTokens        int                    `json:"total_tokens,omitempty"`
+	Usage              *TokenUsage            `json:"usage,omitempty"`
 	Error              string                 `json:"error,omitempty"`
 	ErrorType          string                 `json:"error_type,omitempty"`
 	Metadata           map[string]interface{} `json:"metadata"`
 }
 
+// Token accounting in the common LLM API shape
+type TokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// Add another usage record to this one
+func (u *TokenUsage) Add(other TokenUsage) {
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.TotalTokens += other.TotalTokens
+}
+
+// Running usage across every generation made by this module instance,
+// including retries, so hosts that reuse an instance can track cost
+var sessionUsage TokenUsage
+
 // Ollama API request structure (what gets sent to Ollama)
 type OllamaAPIRequest struct {
 	Model     string                 `json:"model"`
@@ -82,6 +287,7 @@ type OllamaAPIResponse struct {
 	CreatedAt          string `json:"created_at"`
 	Response           string `json:"response"`
 	Done               bool   `json:"done"`
+	DoneReason         string `json:"done_reason,omitempty"`
 	Context            []int  `json:"context,omitempty"`
 	TotalDuration      int64  `json:"total_duration,omitempty"`
 	LoadDuration       int64  `json:"load_duration,omitempty"`
@@ -91,351 +297,6628 @@ type OllamaAPIResponse struct {
 	EvalDuration       int64  `json:"eval_duration,omitempty"`
 }
 
-// Helper function to call Float's log function
-func logToFloat(message string) {
-	if len(message) == 0 {
-		return
-	}
-	messageBytes := []byte(message)
-	ptr := uintptr(unsafe.Pointer(&messageBytes[0]))
-	floatLog(uint32(ptr), uint32(len(messageBytes)))
+// Request for Ollama's /api/chat endpoint
+type ChatAPIRequest struct {
+	Model     string                 `json:"model"`
+	Messages  []ChatMessage          `json:"messages"`
+	Stream    *bool                  `json:"stream,omitempty"`
+	Format    interface{}            `json:"format,omitempty"`
+	Options   map[string]interface{} `json:"options,omitempty"`
+	KeepAlive string                 `json:"keep_alive,omitempty"`
 }
 
-// Helper function to write output file using Float's file system
-func writeOutputFile(data *OllamaOutput) error {
-	jsonData, err := json.MarshalIndent(data, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal output: %v", err)
-	}
+// Response from Ollama's /api/chat endpoint; the reply is in Message
+// instead of Response, the timing fields are shared with /api/generate
+type ChatAPIResponse struct {
+	OllamaAPIResponse
+	Message ChatMessage `json:"message"`
+}
 
-	path := "output.json"
-	pathBytes := []byte(path)
-	pathPtr := uintptr(unsafe.Pointer(&pathBytes[0]))
-	dataPtr := uintptr(unsafe.Pointer(&jsonData[0]))
+// Request to the OpenAI-compatible /v1/chat/completions endpoint
+type OpenAIChatRequest struct {
+	Model       string        `json:"model"`
+	Messages    []ChatMessage `json:"messages"`
+	Temperature *float64      `json:"temperature,omitempty"`
+	MaxTokens   *int          `json:"max_tokens,omitempty"`
+	Stream      bool          `json:"stream"`
+}
 
-	result := floatWriteFile(
-		uint32(pathPtr), uint32(len(pathBytes)),
-		uint32(dataPtr), uint32(len(jsonData)),
-	)
+// Response from /v1/chat/completions; the reply is in the first choice
+type OpenAIChatResponse struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Created int64  `json:"created"`
+	Choices []struct {
+		Index        int         `json:"index"`
+		Message      ChatMessage `json:"message"`
+		FinishReason string      `json:"finish_reason"`
+	} `json:"choices"`
+	Usage TokenUsage `json:"usage"`
+}
 
-	if result != 0 {
-		return fmt.Errorf("failed to write output file")
-	}
+// Request for Ollama's /api/pull endpoint
+type PullAPIRequest struct {
+	Name   string `json:"name"`
+	Stream *bool  `json:"stream,omitempty"`
+}
 
-	return nil
+// Request for Ollama's /api/push endpoint
+type PushAPIRequest struct {
+	Name     string `json:"name"`
+	Insecure bool   `json:"insecure"`
 }
 
-// Make HTTP request using Float's controlled HTTP access
-func makeHttpRequest(url, method, body string) (string, error) {
-	logToFloat(fmt.Sprintf("Making HTTP %s request to %s", method, url))
+// Request for Ollama's /api/create endpoint
+type CreateAPIRequest struct {
+	Name      string `json:"name"`
+	Modelfile string `json:"modelfile"`
+	Stream    bool   `json:"stream"`
+}
 
-	urlBytes := []byte(url)
-	methodBytes := []byte(method)
-	bodyBytes := []byte(body)
+// A status line from /api/pull, /api/push or /api/create; the
+// non-streaming form is a single line
+type PullStatusLine struct {
+	Status    string `json:"status"`
+	Digest    string `json:"digest,omitempty"`
+	Total     int64  `json:"total,omitempty"`
+	Completed int64  `json:"completed,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
 
-	urlPtr := uintptr(unsafe.Pointer(&urlBytes[0]))
-	methodPtr := uintptr(unsafe.Pointer(&methodBytes[0]))
-	bodyPtr := uintptr(unsafe.Pointer(&bodyBytes[0]))
+// Request for Ollama's /api/embeddings endpoint, one prompt per call
+type EmbeddingsAPIRequest struct {
+	Model     string                 `json:"model"`
+	Prompt    string                 `json:"prompt"`
+	Options   map[string]interface{} `json:"options,omitempty"`
+	KeepAlive string                 `json:"keep_alive,omitempty"`
+}
 
-	// Make the HTTP request
-	result := floatHttpRequest(
-		uint32(urlPtr), uint32(len(urlBytes)),
-		uint32(methodPtr), uint32(len(methodBytes)),
-		uint32(bodyPtr), uint32(len(bodyBytes)),
-	)
+// Response from Ollama's /api/embeddings endpoint
+type EmbeddingsAPIResponse struct {
+	Embedding []float64 `json:"embedding"`
+}
 
-	if result != 0 {
-		return "", fmt.Errorf("HTTP request failed with status code: %d", result)
-	}
+// Request for Ollama's /api/embed endpoint
+type EmbedAPIRequest struct {
+	Model     string   `json:"model"`
+	Input     []string `json:"input"`
+	KeepAlive string   `json:"keep_alive,omitempty"`
+}
 
-	// Note: In a real Float implementation, the HTTP response would be available
-	// through Float's response mechanism. For this example, we'll simulate
-	// a successful response format that matches Ollama's API.
-	simulatedResponse := `{
-		"model": "` + extractModelFromRequest(body) + `",
-		"created_at": "` + time.Now().Format(time.RFC3339) + `",
-		"response": "This is a simulated response from Ollama. In production, this would contain the actual AI-generated text based on your prompt.",
-		"done": true,
-		"total_duration": 1000000000,
-		"load_duration": 100000000,
-		"prompt_eval_count": 10,
-		"prompt_eval_duration": 200000000,
-		"eval_count": 25,
-		"eval_duration": 700000000
-	}`
+// Response from Ollama's /api/embed endpoint
+type EmbedAPIResponse struct {
+	Model           string      `json:"model"`
+	Embeddings      [][]float64 `json:"embeddings"`
+	TotalDuration   int64       `json:"total_duration,omitempty"`
+	LoadDuration    int64       `json:"load_duration,omitempty"`
+	PromptEvalCount int         `json:"prompt_eval_count,omitempty"`
+}
 
-	logToFloat("HTTP request completed successfully")
-	return simulatedResponse, nil
+// Response from Ollama's /api/version endpoint
+type VersionAPIResponse struct {
+	Version string `json:"version"`
 }
 
-// Extract model name from request body for response simulation
-func extractModelFromRequest(body string) string {
-	var req map[string]interface{}
-	if err := json.Unmarshal([]byte(body), &req); err != nil {
-		return "unknown"
-	}
-	if model, ok := req["model"].(string); ok {
-		return model
-	}
-	return "unknown"
+// Model details reported by /api/show, /api/tags and /api/ps
+type ModelDetails struct {
+	Format            string   `json:"format,omitempty"`
+	Family            string   `json:"family,omitempty"`
+	Families          []string `json:"families,omitempty"`
+	ParameterSize     string   `json:"parameter_size,omitempty"`
+	QuantizationLevel string   `json:"quantization_level,omitempty"`
 }
 
-// Validate input data according to schema requirements
-func validateInput(input *OllamaInput) error {
-	if input.Model == "" {
-		return fmt.Errorf("model field is required")
-	}
+// Ollama /api/show response structure
+type ShowModelAPIResponse struct {
+	Modelfile    string       `json:"modelfile,omitempty"`
+	Parameters   string       `json:"parameters,omitempty"`
+	Template     string       `json:"template,omitempty"`
+	License      string       `json:"license,omitempty"`
+	Details      ModelDetails `json:"details"`
+	Capabilities []string     `json:"capabilities,omitempty"`
+}
 
-	if input.Prompt == "" {
-		return fmt.Errorf("prompt field is required")
-	}
+// A model currently loaded into memory, as reported by /api/ps
+type RunningModel struct {
+	Name      string       `json:"name"`
+	Model     string       `json:"model"`
+	Size      int64        `json:"size"`
+	SizeVRAM  int64        `json:"size_vram"`
+	Digest    string       `json:"digest,omitempty"`
+	ExpiresAt string       `json:"expires_at,omitempty"`
+	Details   ModelDetails `json:"details"`
+}
 
-	if input.OllamaURL == "" {
-		return fmt.Errorf("ollama_url field is required")
-	}
+// Ollama /api/ps response structure
+type RunningModelsAPIResponse struct {
+	Models []RunningModel `json:"models"`
+}
 
-	// Validate URL format
-	if !strings.HasPrefix(input.OllamaURL, "http://") && !strings.HasPrefix(input.OllamaURL, "https://") {
-		return fmt.Errorf("ollama_url must be a valid HTTP/HTTPS URL")
-	}
+// An installed model, as reported by /api/tags
+type ModelInfo struct {
+	Name         string       `json:"name"`
+	Size         int64        `json:"size"`
+	ModifiedAt   string       `json:"modified_at"`
+	Digest       string       `json:"digest"`
+	Details      ModelDetails `json:"details"`
+	Capabilities []string     `json:"capabilities,omitempty"`
+}
 
-	// Validate prompt length
-	if len(input.Prompt) > 32768 {
-		return fmt.Errorf("prompt exceeds maximum length of 32768 characters")
-	}
+// Ollama /api/tags response structure
+type TagsAPIResponse struct {
+	Models []ModelInfo `json:"models"`
+}
 
-	// Validate system message length if provided
-	if input.System != "" && len(input.System) > 8192 {
-		return fmt.Errorf("system message exceeds maximum length of 8192 characters")
-	}
+// Input structure for list_models_filtered
+type ModelFilterInput struct {
+	OllamaURL         string `json:"ollama_url"`
+	Family            string `json:"family,omitempty"`
+	MinParameterSize  string `json:"min_parameter_size,omitempty"`
+	MaxParameterSize  string `json:"max_parameter_size,omitempty"`
+	QuantizationLevel string `json:"quantization_level,omitempty"`
+	Capability        string `json:"capability,omitempty"`
+	// Fetch /api/show for every candidate; required for capability filters
+	FetchDetails bool `json:"fetch_details,omitempty"`
+}
 
-	// Validate options if provided
-	if input.Options != nil {
-		if temp, ok := input.Options["temperature"]; ok {
-			if tempFloat, ok := temp.(float64); ok && (tempFloat < 0 || tempFloat > 2) {
-				return fmt.Errorf("temperature must be between 0 and 2")
-			}
-		}
-		if topP, ok := input.Options["top_p"]; ok {
-			if topPFloat, ok := topP.(float64); ok && (topPFloat < 0 || topPFloat > 1) {
-				return fmt.Errorf("top_p must be between 0 and 1")
-			}
-		}
-	}
+// Input structure for pull_model
+type PullModelInput struct {
+	Name      string `json:"name"`
+	OllamaURL string `json:"ollama_url"`
+	Stream    *bool  `json:"stream,omitempty"`
 
-	return nil
+	// Pulls started again after an interrupted one, which the server
+	// resumes from the partial layers (default 2, max 5)
+	ResumeAttempts *int `json:"resume_attempts,omitempty"`
 }
 
-// Build metadata for the response
-func buildMetadata(input *OllamaInput, responseLength int) map[string]interface{} {
-	metadata := map[string]interface{}{
-		"input_prompt_length": len(input.Prompt),
-		"response_length":     responseLength,
-		"ollama_url":          input.OllamaURL,
-		"stream_mode":         input.Stream != nil && *input.Stream,
-		"processing_complete": true,
-		"go_version":          "tinygo",
-		"timestamp":           time.Now().Format(time.RFC3339),
-	}
+const (
+	defaultPullResumeAttempts = 2
+	maxPullResumeAttempts     = 5
+)
 
-	if input.System != "" {
-		metadata["has_system_message"] = true
-		metadata["system_message_length"] = len(input.System)
-	}
-	if len(input.Images) > 0 {
-		metadata["image_count"] = len(input.Images)
-		metadata["multimodal_request"] = true
-	}
-	if input.Context != nil && len(input.Context) > 0 {
-		metadata["has_context"] = true
-		metadata["context_length"] = len(input.Context)
-	}
-	if input.Options != nil {
-		metadata["has_custom_options"] = true
-	}
+// Input structure for push_model
+type PushModelInput struct {
+	Name      string `json:"name"`
+	OllamaURL string `json:"ollama_url"`
+	Insecure  bool   `json:"insecure,omitempty"`
+}
 
-	return metadata
+// Input structure for delete_model
+type DeleteModelInput struct {
+	Name      string `json:"name"`
+	OllamaURL string `json:"ollama_url"`
 }
 
-// Create error output with proper structure
-func createErrorOutput(errorMsg, errorType string, metadata map[string]interface{}) *OllamaOutput {
-	if metadata == nil {
-		metadata = make(map[string]interface{})
-	}
-	metadata["processing_complete"] = false
-	metadata["error_timestamp"] = time.Now().Format(time.RFC3339)
+// Output structure for delete_model
+type DeleteModelOutput struct {
+	Success  bool                   `json:"success"`
+	Model    string                 `json:"model"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
 
-	return &OllamaOutput{
-		Success:   false,
-		Error:     errorMsg,
-		ErrorType: errorType,
-		Done:      true,
-		Metadata:  metadata,
-	}
+// Input structure for show_model
+type ShowModelInput struct {
+	Model     string `json:"model"`
+	OllamaURL string `json:"ollama_url"`
 }
 
-// Main entry point function as required by Float
-//
-//export generate_ollama
-func generate_ollama(inputPtr, inputLen uint32) uint32 {
-	logToFloat("Starting Ollama text generation")
+// Output structure for show_model; fields the model does not define are
+// omitted
+type ShowModelOutput struct {
+	Success      bool                   `json:"success"`
+	Model        string                 `json:"model"`
+	Modelfile    string                 `json:"modelfile,omitempty"`
+	Parameters   string                 `json:"parameters,omitempty"`
+	Template     string                 `json:"template,omitempty"`
+	License      string                 `json:"license,omitempty"`
+	Details      ModelDetails           `json:"details"`
+	Capabilities []string               `json:"capabilities,omitempty"`
+	Metadata     map[string]interface{} `json:"metadata"`
+}
 
-	// Read input data
-	inputBytes := make([]byte, inputLen)
-	copy(inputBytes, (*(*[1 << 30]byte)(unsafe.Pointer(uintptr(inputPtr))))[0:inputLen])
+// Input structure for create_model
+type CreateModelInput struct {
+	Name      string `json:"name"`
+	Modelfile string `json:"modelfile"`
+	OllamaURL string `json:"ollama_url"`
+}
 
-	// Parse input JSON
-	var input OllamaInput
-	if err := json.Unmarshal(inputBytes, &input); err != nil {
-		logToFloat(fmt.Sprintf("Failed to parse input JSON: %v", err))
-		output := createErrorOutput(
-			fmt.Sprintf("Invalid input JSON: %v", err),
-			"INPUT_PARSE_ERROR",
-			map[string]interface{}{
-				"error_stage": "input_parsing",
-				"input_size":  len(inputBytes),
-			},
-		)
-		writeOutputFile(output)
-		return 1
-	}
+// Output structure for create_model
+type CreateModelOutput struct {
+	Success  bool                   `json:"success"`
+	Status   string                 `json:"status"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
 
-	logToFloat(fmt.Sprintf("Parsed input for model: %s", input.Model))
+// Input structure for copy_model
+type CopyModelInput struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	OllamaURL   string `json:"ollama_url"`
+}
 
-	// Validate input
-	if err := validateInput(&input); err != nil {
-		logToFloat(fmt.Sprintf("Input validation failed: %v", err))
-		errorType := "VALIDATION_ERROR"
-		metadata := map[string]interface{}{
-			"error_stage": "validation",
-			"model":       input.Model,
-		}
+// Output structure for copy_model
+type CopyModelOutput struct {
+	Success  bool                   `json:"success"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
 
-		if strings.Contains(err.Error(), "model") {
-			metadata["missing_field"] = "model"
-		} else if strings.Contains(err.Error(), "prompt") {
-			metadata["missing_field"] = "prompt"
-		} else if strings.Contains(err.Error(), "ollama_url") {
-			metadata["missing_field"] = "ollama_url"
-		}
+// Output structure for pull_model and push_model
+type PullModelOutput struct {
+	Success        bool                   `json:"success"`
+	Status         string                 `json:"status"`
+	BytesCompleted int64                  `json:"bytes_completed"`
+	BytesTotal     int64                  `json:"bytes_total"`
+	Metadata       map[string]interface{} `json:"metadata"`
+}
 
-		output := createErrorOutput(err.Error(), errorType, metadata)
-		writeOutputFile(output)
-		return 1
-	}
+// Input structure for list_models
+type ListModelsInput struct {
+	OllamaURL string `json:"ollama_url"`
+}
 
-	logToFloat("Input validation passed")
+// Output structure for model listings
+type ModelListOutput struct {
+	Success  bool                   `json:"success"`
+	Models   []ModelInfo            `json:"models"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
 
-	// Ensure URL doesn't end with slash for consistent API calls
-	input.OllamaURL = strings.TrimRight(input.OllamaURL, "/")
+// Input structure for replay_request: a stored request and what it produced
+type ReplayInput struct {
+	Request     OllamaInput  `json:"request"`
+	Stored      OllamaOutput `json:"stored"`
+	ModelDigest string       `json:"model_digest,omitempty"`
+}
 
-	// Set stream to false if not specified (ensure complete response)
-	if input.Stream == nil {
-		streamFalse := false
-		input.Stream = &streamFalse
-	}
+// Input structure for vision_smoke_test
+type VisionSmokeTestInput struct {
+	Model     string `json:"model"`
+	OllamaURL string `json:"ollama_url"`
+}
 
-	// Prepare Ollama API request
-	apiRequest := OllamaAPIRequest{
-		Model:     input.Model,
-		Prompt:    input.Prompt,
-		System:    input.System,
-		Template:  input.Template,
-		Context:   input.Context,
-		Stream:    input.Stream,
-		Raw:       input.Raw,
-		Format:    input.Format,
-		Options:   input.Options,
-		Suffix:    input.Suffix,
-		KeepAlive: input.KeepAlive,
-		Images:    input.Images,
-	}
+// Input structure for edit_document
+type EditDocumentInput struct {
+	Model       string                 `json:"model"`
+	OllamaURL   string                 `json:"ollama_url"`
+	Original    string                 `json:"original"`
+	Instruction string                 `json:"instruction"`
+	Options     map[string]interface{} `json:"options,omitempty"`
+	KeepAlive   string                 `json:"keep_alive,omitempty"`
+}
 
-	// Marshal request body
-	requestBody, err := json.Marshal(apiRequest)
-	if err != nil {
-		logToFloat(fmt.Sprintf("Failed to marshal request: %v", err))
-		output := createErrorOutput(
-			fmt.Sprintf("Failed to prepare request: %v", err),
-			"REQUEST_MARSHAL_ERROR",
-			map[string]interface{}{
-				"error_stage": "request_preparation",
-				"model":       input.Model,
-			},
-		)
-		writeOutputFile(output)
-		return 1
-	}
+// Output structure for edit_document
+type EditDocumentOutput struct {
+	Success    bool                   `json:"success"`
+	Model      string                 `json:"model,omitempty"`
+	EditedText string                 `json:"edited_text"`
+	Diff       string                 `json:"diff"`
+	Metadata   map[string]interface{} `json:"metadata"`
+}
 
-	logToFloat(fmt.Sprintf("Prepared request body (%d bytes)", len(requestBody)))
+// Input structure for latency_profile
+type LatencyProfileInput struct {
+	Model     string `json:"model"`
+	OllamaURL string `json:"ollama_url"`
+}
 
-	// Make HTTP request to Ollama
-	url := input.OllamaURL + "/api/generate"
-	logToFloat(fmt.Sprintf("Making request to Ollama API: %s", url))
+// Output structure for latency_profile
+type LatencyProfileOutput struct {
+	Success  bool                   `json:"success"`
+	Model    string                 `json:"model"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
 
-	responseBody, err := makeHttpRequest(url, "POST", string(requestBody))
-	if err != nil {
-		logToFloat(fmt.Sprintf("HTTP request failed: %v", err))
-		output := createErrorOutput(
-			fmt.Sprintf("Failed to connect to Ollama server: %v", err),
-			"HTTP_REQUEST_ERROR",
-			map[string]interface{}{
-				"error_stage": "http_request",
-				"ollama_url":  url,
+// Input structure for warm_models
+type WarmModelsInput struct {
+	Models    []string `json:"models"`
+	OllamaURL string   `json:"ollama_url"`
+	KeepAlive string   `json:"keep_alive,omitempty"`
+}
+
+// Output structure for warm_models
+type WarmModelsOutput struct {
+	Success   bool                   `json:"success"`
+	Ready     map[string]bool        `json:"ready"`
+	Error     string                 `json:"error,omitempty"`
+	ErrorType string                 `json:"error_type,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata"`
+}
+
+// Input structure for generate_embeddings; Prompt for a single text or
+// Input for a batch
+type EmbeddingsInput struct {
+	Model     string                 `json:"model"`
+	OllamaURL string                 `json:"ollama_url"`
+	Prompt    string                 `json:"prompt,omitempty"`
+	Input     []string               `json:"input,omitempty"`
+	Options   map[string]interface{} `json:"options,omitempty"`
+	KeepAlive string                 `json:"keep_alive,omitempty"`
+}
+
+// Output structure for generate_embeddings
+type EmbeddingsOutput struct {
+	Success    bool                   `json:"success"`
+	Model      string                 `json:"model"`
+	Embedding  []float64              `json:"embedding,omitempty"`
+	Embeddings [][]float64            `json:"embeddings,omitempty"`
+	Metadata   map[string]interface{} `json:"metadata"`
+}
+
+// Two texts to compare
+type TextPair struct {
+	A string `json:"a"`
+	B string `json:"b"`
+}
+
+// Input structure for text_similarity; either TextA and TextB or Pairs
+type TextSimilarityInput struct {
+	Model          string     `json:"model"`
+	OllamaURL      string     `json:"ollama_url"`
+	TextA          string     `json:"text_a,omitempty"`
+	TextB          string     `json:"text_b,omitempty"`
+	Pairs          []TextPair `json:"pairs,omitempty"`
+	IncludeVectors bool       `json:"include_vectors,omitempty"`
+	KeepAlive      string     `json:"keep_alive,omitempty"`
+}
+
+// Output structure for text_similarity
+type TextSimilarityOutput struct {
+	Success      bool                   `json:"success"`
+	Model        string                 `json:"model"`
+	Similarity   *float64               `json:"similarity,omitempty"`
+	Similarities []float64              `json:"similarities,omitempty"`
+	Vectors      [][]float64            `json:"vectors,omitempty"`
+	Metadata     map[string]interface{} `json:"metadata"`
+}
+
+// Input structure for require_version; Feature is looked up in
+// featureMinVersions unless MinVersion is given explicitly
+type RequireVersionInput struct {
+	OllamaURL  string `json:"ollama_url"`
+	Feature    string `json:"feature,omitempty"`
+	MinVersion string `json:"min_version,omitempty"`
+}
+
+// Output structure for require_version
+type RequireVersionOutput struct {
+	Success   bool                   `json:"success"`
+	Supported bool                   `json:"supported"`
+	Metadata  map[string]interface{} `json:"metadata"`
+}
+
+// Input structure for check_server
+type CheckServerInput struct {
+	OllamaURL string `json:"ollama_url"`
+}
+
+// Output structure for check_server
+type CheckServerOutput struct {
+	Success   bool                   `json:"success"`
+	Reachable bool                   `json:"reachable"`
+	Version   string                 `json:"version,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	ErrorType string                 `json:"error_type,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata"`
+}
+
+// A chat turn
+type ChatMessage struct {
+	Role    string   `json:"role"`
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"`
+}
+
+// Input structure for generate_chat
+type ChatInput struct {
+	Model     string                 `json:"model"`
+	Messages  []ChatMessage          `json:"messages"`
+	OllamaURL string                 `json:"ollama_url"`
+	Stream    *bool                  `json:"stream,omitempty"`
+	Format    interface{}            `json:"format,omitempty"`
+	Options   map[string]interface{} `json:"options,omitempty"`
+	KeepAlive string                 `json:"keep_alive,omitempty"`
+
+	// Rejected when set: /api/chat has no fill-in-the-middle suffix
+	Suffix string `json:"suffix,omitempty"`
+
+	// Most recent non-system messages kept, dropping older ones; system
+	// messages are always kept. Zero sends the full history.
+	MaxHistoryMessages int `json:"max_history_messages,omitempty"`
+}
+
+// Input structure for generate_openai_chat
+type OpenAIChatInput struct {
+	Model       string        `json:"model"`
+	Messages    []ChatMessage `json:"messages"`
+	OllamaURL   string        `json:"ollama_url"`
+	Temperature *float64      `json:"temperature,omitempty"`
+	MaxTokens   *int          `json:"max_tokens,omitempty"`
+}
+
+// Input structure for generate_batch; the model, options and settings
+// are shared by all prompts
+type BatchInput struct {
+	Model     string                 `json:"model"`
+	Prompts   []string               `json:"prompts"`
+	OllamaURL string                 `json:"ollama_url"`
+	System    string                 `json:"system,omitempty"`
+	Format    interface{}            `json:"format,omitempty"`
+	Options   map[string]interface{} `json:"options,omitempty"`
+	KeepAlive string                 `json:"keep_alive,omitempty"`
+
+	// Run the valid prompts when some fail validation, instead of
+	// rejecting the whole batch before any request is made
+	SkipInvalid bool `json:"skip_invalid,omitempty"`
+}
+
+// A batch prompt that failed validation
+type InvalidBatchPrompt struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// Result of one prompt of a batch
+type BatchResult struct {
+	Index           int    `json:"index"`
+	Response        string `json:"response"`
+	PromptEvalCount int    `json:"prompt_eval_count,omitempty"`
+	EvalCount       int    `json:"eval_count,omitempty"`
+	TotalDuration   int64  `json:"total_duration,omitempty"`
+	Error           string `json:"error,omitempty"`
+	ErrorType       string `json:"error_type,omitempty"`
+}
+
+// Output structure for generate_batch
+type BatchOutput struct {
+	Success   bool                   `json:"success"`
+	Model     string                 `json:"model"`
+	Responses []BatchResult          `json:"responses"`
+	Error     string                 `json:"error,omitempty"`
+	ErrorType string                 `json:"error_type,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata"`
+}
+
+const maxBatchPrompts = 100
+
+// Input structure for prepare_raw_prompt
+type PrepareRawPromptInput struct {
+	Model     string        `json:"model"`
+	OllamaURL string        `json:"ollama_url"`
+	System    string        `json:"system,omitempty"`
+	Prompt    string        `json:"prompt,omitempty"`
+	Messages  []ChatMessage `json:"messages,omitempty"`
+}
+
+// Output structure for prepare_raw_prompt
+type PrepareRawPromptOutput struct {
+	Success  bool                   `json:"success"`
+	Model    string                 `json:"model"`
+	Prompt   string                 `json:"prompt"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+// Input structure for estimate_vram
+type VRAMEstimateInput struct {
+	Model     string `json:"model"`
+	OllamaURL string `json:"ollama_url"`
+	// Total GPU memory in bytes, when known; improves the fit prediction
+	GPUVRAMBytes int64 `json:"gpu_vram_bytes,omitempty"`
+}
+
+// Output structure for estimate_vram
+type VRAMEstimateOutput struct {
+	Success            bool                   `json:"success"`
+	Model              string                 `json:"model"`
+	ParameterSize      string                 `json:"parameter_size,omitempty"`
+	QuantizationLevel  string                 `json:"quantization_level,omitempty"`
+	EstimatedVRAMBytes int64                  `json:"estimated_vram_bytes"`
+	WillLikelyFit      bool                   `json:"will_likely_fit"`
+	Metadata           map[string]interface{} `json:"metadata"`
+}
+
+// Helper function to call Float's log function
+func logToFloat(message string) {
+	if len(message) == 0 {
+		return
+	}
+	messageBytes := []byte(message)
+	ptr := uintptr(unsafe.Pointer(&messageBytes[0]))
+	floatLog(uint32(ptr), uint32(len(messageBytes)))
+}
+
+// Log levels by increasing severity
+var logLevels = map[string]int{"debug": 0, "info": 1, "error": 2}
+
+const defaultLogLevel = "info"
+
+// Level below which log lines are dropped, set from the input's log_level
+var activeLogLevel = defaultLogLevel
+
+// Correlation id of the current invocation, from the input's request_id
+// or generated by setRequestID
+var activeRequestID string
+
+// File the current invocation's input was read from, for
+// generate_ollama_from_file; empty when it came from the input buffer
+var activeInputPath string
+
+// Invocations of this module instance, making generated request ids unique
+var requestCounter int
+
+// HTTP settings every export accepts, read from the raw input by
+// setRequestSettings
+type requestSettings struct {
+	TraceParent    string   `json:"traceparent"`
+	TraceID        string   `json:"trace_id"`
+	SpanID         string   `json:"span_id"`
+	MaxRetries     int      `json:"max_retries"`
+	RetryBackoffMs int      `json:"retry_backoff_ms"`
+	ResponsePaths  []string `json:"response_paths"`
+}
+
+// HTTP settings and trace context of the current invocation, shared by
+// every request it makes through newRequestOptions
+var (
+	activeRequestSettings requestSettings
+	activeTrace           *traceContext
+)
+
+// A structured line written to Float's log
+type logLine struct {
+	Level     string `json:"level"`
+	RequestID string `json:"request_id,omitempty"`
+	Msg       string `json:"msg"`
+	Ts        string `json:"ts"`
+}
+
+// Emit a JSON log line if level is at or above the active level
+func logAt(level, format string, args ...interface{}) {
+	if logLevels[level] < logLevels[activeLogLevel] {
+		return
+	}
+	line, err := json.Marshal(logLine{
+		Level:     level,
+		RequestID: activeRequestID,
+		Msg:       fmt.Sprintf(format, args...),
+		Ts:        time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		return
+	}
+	logToFloat(string(line))
+}
+
+func logDebug(format string, args ...interface{}) { logAt("debug", format, args...) }
+func logInfo(format string, args ...interface{})  { logAt("info", format, args...) }
+func logError(format string, args ...interface{}) { logAt("error", format, args...) }
+
+// Apply the log_level of raw input JSON, falling back to the default for
+// a missing or unknown level
+func setLogLevel(inputBytes []byte) {
+	var probe struct {
+		LogLevel string `json:"log_level"`
+	}
+	activeLogLevel = defaultLogLevel
+	if json.Unmarshal(inputBytes, &probe) == nil {
+		if _, ok := logLevels[probe.LogLevel]; ok {
+			activeLogLevel = probe.LogLevel
+		}
+	}
+}
+
+// Apply the request_id of raw input JSON, or generate one from the clock
+// and the invocation counter. An invalid id is still reported by
+// validation, so it is not used here.
+func setRequestID(inputBytes []byte) {
+	var probe struct {
+		RequestID string `json:"request_id"`
+	}
+	requestCounter++
+	if json.Unmarshal(inputBytes, &probe) == nil && probe.RequestID != "" &&
+		validateIDToken("request_id", probe.RequestID) == nil {
+		activeRequestID = probe.RequestID
+		return
+	}
+	activeRequestID = fmt.Sprintf("req-%d-%d", time.Now().UnixMilli(), requestCounter)
+}
+
+// Apply the trace context, retry settings and response_paths of raw input
+// JSON. Invalid values are dropped here; generate_ollama's validation
+// still reports them.
+func setRequestSettings(inputBytes []byte) {
+	var probe requestSettings
+	activeRequestSettings = requestSettings{}
+	activeTrace = nil
+	if json.Unmarshal(inputBytes, &probe) != nil {
+		return
+	}
+	if validateTraceFields(probe.TraceParent, probe.TraceID, probe.SpanID) == nil {
+		activeTrace = newTraceContext(probe.TraceParent, probe.TraceID, probe.SpanID)
+	}
+	if validateRetrySettings(probe.MaxRetries, probe.RetryBackoffMs) == nil {
+		activeRequestSettings.MaxRetries = probe.MaxRetries
+		activeRequestSettings.RetryBackoffMs = probe.RetryBackoffMs
+	}
+	if validateResponsePaths(probe.ResponsePaths) == nil {
+		activeRequestSettings.ResponsePaths = probe.ResponsePaths
+	}
+}
+
+// Helper function to write output file using Float's file system. Every
+// output written here carries metadata.request_id, success or failure.
+func writeOutputFile(data interface{}) error {
+	setOutputRequestID(data)
+	return writeJSONFile(outputFile, data)
+}
+
+// File the host reads each export's result from
+const outputFile = "output.json"
+
+// Write data as indented JSON to a file through the Float host
+func writeJSONFile(path string, data interface{}) error {
+	jsonData, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal output: %v", err)
+	}
+
+	if err := writeFloatFile(path, jsonData); err != nil {
+		return fmt.Errorf("failed to write output file")
+	}
+
+	return nil
+}
+
+// Write an error output to output.json and return the exports' failure
+// code. Exports report errors through here or writeErrorOutput, so error
+// outputs share one shape.
+func writeError(errType, msg string, meta map[string]interface{}) uint32 {
+	metadata := make(map[string]interface{}, len(meta)+1)
+	for key, value := range meta {
+		metadata[key] = value
+	}
+	return writeErrorOutput(createErrorOutput(msg, errType, metadata))
+}
+
+// Write a failed output built elsewhere, such as by runGeneration or an
+// export with its own output type, to output.json and return the
+// exports' failure code
+func writeErrorOutput(output interface{}) uint32 {
+	if err := writeOutputFile(output); err != nil {
+		logError("Failed to write output file: %v", err)
+	}
+	return 1
+}
+
+// Add request_id to the Metadata map every export's output struct has
+func setOutputRequestID(output interface{}) {
+	if activeRequestID == "" {
+		return
+	}
+	value := reflect.ValueOf(output)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return
+	}
+	field := value.Elem().FieldByName("Metadata")
+	if !field.IsValid() {
+		return
+	}
+	metadata, ok := field.Interface().(map[string]interface{})
+	if !ok {
+		return
+	}
+	if metadata == nil {
+		metadata = make(map[string]interface{})
+		field.Set(reflect.ValueOf(metadata))
+	}
+	metadata["request_id"] = activeRequestID
+}
+
+// Write a generation's output to output.json, or with SkipOutputFile log
+// it as one JSON line, at the error level for a failed output
+func writeGenerationOutput(input *OllamaInput, output *OllamaOutput) error {
+	if !input.SkipOutputFile {
+		return writeOutputFile(output)
+	}
+	setOutputRequestID(output)
+	jsonData, err := json.Marshal(output)
+	if err != nil {
+		return fmt.Errorf("failed to marshal output: %v", err)
+	}
+	if output.Success {
+		logInfo("Output: %s", jsonData)
+	} else {
+		logError("Output: %s", jsonData)
+	}
+	return nil
+}
+
+// Write data to a file through the Float host, replacing its contents;
+// empty data truncates the file
+func writeFloatFile(path string, data []byte) error {
+	pathBytes := []byte(path)
+	pathPtr := uintptr(unsafe.Pointer(&pathBytes[0]))
+	var dataPtr uintptr
+	if len(data) > 0 {
+		dataPtr = uintptr(unsafe.Pointer(&data[0]))
+	}
+
+	result := floatWriteFile(
+		uint32(pathPtr), uint32(len(pathBytes)),
+		uint32(dataPtr), uint32(len(data)),
+	)
+
+	if result != 0 {
+		return fmt.Errorf("failed to write %s", path)
+	}
+
+	return nil
+}
+
+// A single entry of the lifecycle event log
+type lifecycleEvent struct {
+	Timestamp string `json:"timestamp"`
+	Stage     string `json:"stage"`
+	Status    string `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// JSON-lines event log. The host can only replace whole files, so events
+// are kept in memory and the full log is rewritten on every event; each
+// write leaves a complete, parseable file behind even if a later one fails.
+type eventLog struct {
+	path  string
+	lines []byte
+}
+
+// Create an event log, or nil when no usable path is configured
+func newEventLog(path string) *eventLog {
+	if strings.TrimSpace(path) == "" || path == outputFile {
+		return nil
+	}
+	return &eventLog{path: path}
+}
+
+// Append an event and flush the log. Safe to call on a nil log.
+func (l *eventLog) record(stage, status, detail string) {
+	if l == nil {
+		return
+	}
+	line, err := json.Marshal(lifecycleEvent{
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Stage:     stage,
+		Status:    status,
+		Detail:    detail,
+	})
+	if err != nil {
+		return
+	}
+	l.lines = append(append(l.lines, line...), '\n')
+	if err := writeFloatFile(l.path, l.lines); err != nil {
+		logError("Failed to write event log: %v", err)
+	}
+}
+
+// Per-request HTTP settings derived from the input
+type httpRequestOptions struct {
+	Trace          *traceContext
+	MaxRetries     int
+	RetryBackoffMs int
+
+	// Accept an empty response body, for endpoints such as /api/delete
+	// that answer with a bare status
+	AllowEmptyBody bool
+
+	// Candidate response body files; defaultResponsePaths when empty
+	ResponsePaths []string
+
+	// Set by makeHttpRequest to the number of attempts made, the file the
+	// body was read from, whether it was gzip-compressed and the wall-clock
+	// time the exchange took
+	Attempts     int
+	ResponsePath string
+	Compressed   bool
+	LatencyMs    int64
+}
+
+const defaultRetryBackoffMs = 500
+
+// Longest wait before a single retry, and longest total wait across all
+// of a request's retries
+const (
+	maxRetryDelayMs     = 30000
+	maxRetryTotalWaitMs = 180000
+)
+
+// Wait before retry number attempt+1: backoffMs doubled per attempt,
+// clamped to maxRetryDelayMs
+func retryDelayMs(backoffMs, attempt int) int {
+	if backoffMs == 0 {
+		backoffMs = defaultRetryBackoffMs
+	}
+	delay := backoffMs
+	for i := 0; i < attempt && delay < maxRetryDelayMs; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelayMs {
+		delay = maxRetryDelayMs
+	}
+	return delay
+}
+
+// Check max_retries and retry_backoff_ms, including that the waits of
+// every retry add up to no more than maxRetryTotalWaitMs
+func validateRetrySettings(maxRetries, backoffMs int) error {
+	if maxRetries < 0 || maxRetries > 10 {
+		return fmt.Errorf("max_retries must be between 0 and 10")
+	}
+	if backoffMs < 0 || backoffMs > 60000 {
+		return fmt.Errorf("retry_backoff_ms must be between 0 and 60000")
+	}
+	total := 0
+	for attempt := 0; attempt < maxRetries; attempt++ {
+		total += retryDelayMs(backoffMs, attempt)
+	}
+	if total > maxRetryTotalWaitMs {
+		return fmt.Errorf("max_retries and retry_backoff_ms would wait %dms in total between retries, more than %dms", total, maxRetryTotalWaitMs)
+	}
+	return nil
+}
+
+// Returned by makeHttpRequest when the host reports a non-zero status.
+// ServerError holds the "error" field of a 4xx/5xx body, if any.
+type httpStatusError struct {
+	Status      uint32
+	ServerError string
+}
+
+func (e *httpStatusError) Error() string {
+	if e.ServerError != "" {
+		return fmt.Sprintf("HTTP request failed with status code: %d: %s", e.Status, e.ServerError)
+	}
+	return fmt.Sprintf("HTTP request failed with status code: %d", e.Status)
+}
+
+// Extract the message from an Ollama error body such as
+// {"error":"model 'x' not found"}; anything else yields ""
+func parseServerError(body string) string {
+	var serverErr struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(body)), &serverErr); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(serverErr.Error)
+}
+
+// The host writes error bodies to the response file too. It gives no
+// guarantee that a failed request rewrites the file, so makeHttpRequest
+// empties the response files before each send and only calls this when
+// that succeeded: any body found then belongs to the failed request.
+func readServerError(opts *httpRequestOptions) string {
+	rawBody, err := readResponseBody(opts)
+	if err != nil {
+		return ""
+	}
+	if isGzip(rawBody) {
+		if rawBody, err = gunzip(rawBody); err != nil {
+			return ""
+		}
+	}
+	return parseServerError(string(rawBody))
+}
+
+// Messages Ollama gives when a model does not fit in the available
+// system or GPU memory
+var insufficientMemoryPattern = regexp.MustCompile(`(?i)requires more (system )?memory|out of memory|insufficient memory|not enough memory`)
+
+// Report whether the controller has written "cancel" to the cancel file;
+// a missing or unreadable file means carry on
+func cancelRequested(path string) bool {
+	if path == "" {
+		return false
+	}
+	content, err := readFloatFileContent(path)
+	return err == nil && strings.TrimSpace(content) == "cancel"
+}
+
+// Error output for a failed HTTP request with the status in
+// metadata.http_status: 4xx maps to CLIENT_ERROR, 5xx to SERVER_ERROR and
+// anything else to HTTP_REQUEST_ERROR. notFoundHint is added to a 404,
+// and a server error message about memory maps to INSUFFICIENT_MEMORY.
+func httpRequestErrorOutput(err error, metadata map[string]interface{}, notFoundHint string) *OllamaOutput {
+	if readErr, ok := err.(*responseReadError); ok {
+		metadata["response_paths_tried"] = readErr.Paths
+	}
+	// The host reports every 2xx status as success without the code
+	if _, ok := err.(*emptyResponseError); ok {
+		metadata["error_stage"] = "response_reading"
+		metadata["http_status_class"] = "2xx"
+		return createErrorOutput(
+			fmt.Sprintf("Ollama server returned no content: %v; check any proxy between Float and Ollama", err),
+			"EMPTY_RESPONSE",
+			metadata,
+		)
+	}
+	statusErr, ok := err.(*httpStatusError)
+	if !ok {
+		return createErrorOutput(
+			fmt.Sprintf("Failed to connect to Ollama server: %v", err),
+			"HTTP_REQUEST_ERROR",
+			metadata,
+		)
+	}
+
+	metadata["http_status"] = statusErr.Status
+	errorType := "HTTP_REQUEST_ERROR"
+	switch {
+	case statusErr.Status >= 400 && statusErr.Status < 500:
+		errorType = "CLIENT_ERROR"
+	case statusErr.Status >= 500 && statusErr.Status < 600:
+		errorType = "SERVER_ERROR"
+	}
+	message := fmt.Sprintf("Ollama server returned HTTP %d", statusErr.Status)
+	if statusErr.ServerError != "" {
+		metadata["server_error"] = statusErr.ServerError
+		message += ": " + statusErr.ServerError
+		if insufficientMemoryPattern.MatchString(statusErr.ServerError) {
+			return createErrorOutput(
+				message+" (the model does not fit in memory; try a smaller quantization such as a q4_0 tag, a smaller model, or unload other models)",
+				"INSUFFICIENT_MEMORY",
+				metadata,
+			)
+		}
+	}
+	if statusErr.Status == 404 && notFoundHint != "" {
+		message += fmt.Sprintf(" (%s)", notFoundHint)
+	}
+	return createErrorOutput(message, errorType, metadata)
+}
+
+// Write the error output for a request an export made through one of the
+// fetch helpers: a status from the server is reported as by
+// httpRequestErrorOutput, so memory errors map to INSUFFICIENT_MEMORY,
+// and any other failure is HTTP_REQUEST_ERROR prefixed with message
+func writeFetchError(err error, message string, metadata map[string]interface{}) uint32 {
+	if _, ok := err.(*httpStatusError); ok {
+		return writeErrorOutput(httpRequestErrorOutput(err, metadata, ""))
+	}
+	return writeError("HTTP_REQUEST_ERROR", fmt.Sprintf("%s: %v", message, err), metadata)
+}
+
+// Build the HTTP settings for one request from the invocation's settings
+func newRequestOptions() *httpRequestOptions {
+	return &httpRequestOptions{
+		Trace:          activeTrace,
+		MaxRetries:     activeRequestSettings.MaxRetries,
+		RetryBackoffMs: activeRequestSettings.RetryBackoffMs,
+		ResponsePaths:  activeRequestSettings.ResponsePaths,
+	}
+}
+
+// Build the HTTP settings for a generation, letting the input's own fields
+// override the invocation's, as for a replayed request
+func requestOptionsFromInput(input *OllamaInput) *httpRequestOptions {
+	opts := newRequestOptions()
+	if trace := newTraceContext(input.TraceParent, input.TraceID, input.SpanID); trace != nil {
+		opts.Trace = trace
+	}
+	if input.MaxRetries != 0 {
+		opts.MaxRetries = input.MaxRetries
+	}
+	if input.RetryBackoffMs != 0 {
+		opts.RetryBackoffMs = input.RetryBackoffMs
+	}
+	if len(input.ResponsePaths) > 0 {
+		opts.ResponsePaths = input.ResponsePaths
+	}
+	return opts
+}
+
+// Make HTTP request using Float's controlled HTTP access
+func makeHttpRequest(url, method, body string, opts *httpRequestOptions) (string, error) {
+	logInfo("Making HTTP %s request to %s", method, url)
+	if body != "" {
+		if activeLogLevel == "debug" {
+			logDebug("Request body: %s", body)
+		} else {
+			logInfo("Request body: %s", redactRequestBody(body))
+		}
+	}
+
+	if opts == nil {
+		opts = newRequestOptions()
+	}
+
+	// Measured from the first send until the response has been decoded,
+	// covering retries and Float's file-based response hand-off
+	start := time.Now()
+	defer func() {
+		opts.LatencyMs = time.Since(start).Milliseconds()
+	}()
+
+	// Retry connection-level failures with exponential backoff; 4xx-class
+	// statuses are final
+	opts.Attempts = 0
+	for attempt := 0; ; attempt++ {
+		opts.Attempts++
+		cleared := clearResponseFiles(opts)
+		result := sendHttpRequest(url, method, body, opts)
+		if result == 0 {
+			break
+		}
+		if attempt >= opts.MaxRetries || (result >= 400 && result < 500) {
+			statusErr := &httpStatusError{Status: result}
+			if result >= 400 && result < 600 && cleared {
+				statusErr.ServerError = readServerError(opts)
+			}
+			return "", statusErr
+		}
+		delay := retryDelayMs(opts.RetryBackoffMs, attempt)
+		logInfo("HTTP request failed with status code %d, retrying in %dms (%d/%d)", result, delay, attempt+1, opts.MaxRetries)
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+	}
+
+	// Float writes the response body to a file rather than returning it
+	rawBody, err := readResponseBody(opts)
+	if err != nil {
+		return "", err
+	}
+	opts.Compressed = isGzip(rawBody)
+	if opts.Compressed {
+		if rawBody, err = gunzip(rawBody); err != nil {
+			return "", &responseDecodeError{Err: err}
+		}
+	}
+	if !utf8.Valid(rawBody) {
+		return "", &responseDecodeError{Err: fmt.Errorf("response body is not valid UTF-8")}
+	}
+	responseBody := string(rawBody)
+	if !opts.AllowEmptyBody && strings.TrimSpace(responseBody) == "" {
+		return "", &emptyResponseError{Bytes: len(responseBody)}
+	}
+
+	logInfo("HTTP request completed successfully (%d bytes)", len(responseBody))
+	logDebug("Response body: %s", responseBody)
+	return responseBody, nil
+}
+
+// Empty the candidate response files so nothing an earlier request left
+// there can be mistaken for this one's body. Reports whether all of them
+// were cleared.
+func clearResponseFiles(opts *httpRequestOptions) bool {
+	paths := opts.ResponsePaths
+	if len(paths) == 0 {
+		paths = defaultResponsePaths
+	}
+	cleared := true
+	for _, path := range paths {
+		if err := writeFloatFile(path, nil); err != nil {
+			logDebug("Could not clear response file %s: %v", path, err)
+			cleared = false
+		}
+	}
+	return cleared
+}
+
+// Read the response body from the first candidate file that can be read
+func readResponseBody(opts *httpRequestOptions) ([]byte, error) {
+	paths := opts.ResponsePaths
+	if len(paths) == 0 {
+		paths = defaultResponsePaths
+	}
+	var lastErr error
+	emptyPath := ""
+	for _, path := range paths {
+		rawBody, err := readFloatFileBytes(path, maxReadFileSize)
+		if _, empty := err.(*emptyFileError); empty {
+			if opts.AllowEmptyBody {
+				rawBody, err = nil, nil
+			} else if emptyPath == "" {
+				emptyPath = path
+			}
+		}
+		if err != nil {
+			logDebug("Response not readable from %s: %v", path, err)
+			lastErr = err
+			continue
+		}
+		opts.ResponsePath = path
+		if len(paths) > 1 {
+			logInfo("Read HTTP response from %s", path)
+		}
+		return rawBody, nil
+	}
+	// An empty file means the host did write the (empty) response
+	if emptyPath != "" {
+		opts.ResponsePath = emptyPath
+		return nil, &emptyResponseError{}
+	}
+	return nil, &responseReadError{Paths: paths, Err: lastErr}
+}
+
+// Returned by makeHttpRequest when a successful response has an empty or
+// whitespace-only body, as some misconfigured proxies send
+type emptyResponseError struct {
+	Bytes int
+}
+
+func (e *emptyResponseError) Error() string {
+	if e.Bytes > 0 {
+		return fmt.Sprintf("server returned a whitespace-only response body (%d bytes)", e.Bytes)
+	}
+	return "server returned an empty response body"
+}
+
+// Returned by makeHttpRequest when no candidate response file could be read
+type responseReadError struct {
+	Paths []string
+	Err   error
+}
+
+func (e *responseReadError) Error() string {
+	return fmt.Sprintf("failed to read HTTP response from %s: %v", strings.Join(e.Paths, ", "), e.Err)
+}
+
+// Record the measured wall-clock latency of a request
+func addLatencyMetadata(metadata map[string]interface{}, opts *httpRequestOptions) {
+	metadata["e2e_latency_ms"] = opts.LatencyMs
+}
+
+// Report whether data starts with the gzip magic bytes
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// Decompress a gzip body, refusing output beyond maxReadFileSize
+func gunzip(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip body: %v", err)
+	}
+	defer reader.Close()
+	decompressed, err := io.ReadAll(io.LimitReader(reader, maxReadFileSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress gzip body: %v", err)
+	}
+	if len(decompressed) > maxReadFileSize {
+		return nil, fmt.Errorf("decompressed body exceeds %d bytes", maxReadFileSize)
+	}
+	return decompressed, nil
+}
+
+// Returned by makeHttpRequest when the response body could not be decoded
+type responseDecodeError struct {
+	Err error
+}
+
+func (e *responseDecodeError) Error() string {
+	return fmt.Sprintf("failed to decode HTTP response: %v", e.Err)
+}
+
+// Request body fields replaced before logging at any depth: content and
+// images cover chat messages, input the texts sent to /api/embed
+var redactedLogFields = map[string]bool{
+	"prompt":  true,
+	"suffix":  true,
+	"system":  true,
+	"images":  true,
+	"content": true,
+	"input":   true,
+}
+
+// Render a JSON request body for logging with prompt text and images
+// replaced by their length. A body that is not JSON is reduced to its size.
+func redactRequestBody(body string) string {
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(body), &parsed); err != nil {
+		return fmt.Sprintf("[%d bytes]", len(body))
+	}
+	redacted, err := json.Marshal(redactLogValue(parsed))
+	if err != nil {
+		return fmt.Sprintf("[%d bytes]", len(body))
+	}
+	return string(redacted)
+}
+
+// Replace redacted fields at any depth; strings report their length in
+// bytes and arrays their number of elements
+func redactLogValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if !redactedLogFields[key] {
+				v[key] = redactLogValue(field)
+				continue
+			}
+			switch f := field.(type) {
+			case string:
+				v[key] = fmt.Sprintf("[REDACTED length=%d]", len(f))
+			case []interface{}:
+				v[key] = fmt.Sprintf("[REDACTED length=%d]", len(f))
+			default:
+				v[key] = "[REDACTED]"
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactLogValue(item)
+		}
+	}
+	return value
+}
+
+// Send one HTTP request through the host and return its status code.
+// float_http_request takes no headers, so a traced call's child span is
+// only logged.
+func sendHttpRequest(url, method, body string, opts *httpRequestOptions) uint32 {
+	if opts.Trace != nil {
+		logDebug("traceparent %s for %s %s", opts.Trace.nextTraceParent(), method, url)
+	}
+
+	urlBytes := []byte(url)
+	methodBytes := []byte(method)
+	bodyBytes := []byte(body)
+
+	urlPtr := uintptr(unsafe.Pointer(&urlBytes[0]))
+	methodPtr := uintptr(unsafe.Pointer(&methodBytes[0]))
+
+	// GET requests have no body; pass a null pointer rather than indexing
+	// into an empty slice
+	var bodyPtr uintptr
+	if len(bodyBytes) > 0 {
+		bodyPtr = uintptr(unsafe.Pointer(&bodyBytes[0]))
+	}
+
+	return floatHttpRequest(
+		uint32(urlPtr), uint32(len(urlBytes)),
+		uint32(methodPtr), uint32(len(methodBytes)),
+		uint32(bodyPtr), uint32(len(bodyBytes)),
+	)
+}
+
+// File the host writes each HTTP response body to
+const httpResponseFile = "http_response.json"
+
+// Response body files tried when the input sets no response_paths
+var defaultResponsePaths = []string{httpResponseFile}
+
+const (
+	initialReadBufferSize = 64 * 1024
+	maxReadFileSize       = 64 * 1024 * 1024
+)
+
+// Read a whole text file through the Float host, rejecting content that
+// is not UTF-8
+func readFloatFileContent(path string) (string, error) {
+	content, err := readFloatFileBytes(path, maxReadFileSize)
+	if err != nil {
+		return "", err
+	}
+	if !utf8.Valid(content) {
+		return "", fmt.Errorf("%s is not valid UTF-8", path)
+	}
+	return string(content), nil
+}
+
+// Returned by float_read_file when the path is rejected or unreadable
+const floatReadFailed = ^uint32(0)
+
+// Read a whole file of at most limit bytes through the Float host.
+// float_read_file copies up to the buffer size and returns the file's full
+// length, so a longer file is read again into a buffer of that length.
+func readFloatFileBytes(path string, limit uint32) ([]byte, error) {
+	pathBytes := []byte(path)
+	pathPtr := uintptr(unsafe.Pointer(&pathBytes[0]))
+
+	buffer := make([]byte, initialReadBufferSize)
+	for {
+		bufferPtr := uintptr(unsafe.Pointer(&buffer[0]))
+		size := floatReadFile(
+			uint32(pathPtr), uint32(len(pathBytes)),
+			uint32(bufferPtr), uint32(len(buffer)),
+		)
+		switch {
+		case size == floatReadFailed:
+			return nil, fmt.Errorf("reading %s failed", path)
+		case size == 0:
+			return nil, &emptyFileError{Path: path}
+		case size <= uint32(len(buffer)):
+			return buffer[:size], nil
+		case size > limit:
+			return nil, fmt.Errorf("%s exceeds %d bytes", path, limit)
+		}
+		buffer = make([]byte, size)
+	}
+}
+
+// Returned by readFloatFileBytes for a file without content
+type emptyFileError struct {
+	Path string
+}
+
+func (e *emptyFileError) Error() string {
+	return fmt.Sprintf("%s is empty", e.Path)
+}
+
+// W3C trace context shared by all HTTP calls of one invocation
+type traceContext struct {
+	TraceID      string
+	ParentSpanID string
+	Flags        string
+	Current      string
+}
+
+// Create the trace context from a traceparent or a trace_id and span_id,
+// or nil when tracing is not requested
+func newTraceContext(traceParent, traceID, spanID string) *traceContext {
+	if traceParent != "" {
+		parts := strings.Split(traceParent, "-")
+		if len(parts) != 4 {
+			return nil
+		}
+		return &traceContext{TraceID: parts[1], ParentSpanID: parts[2], Flags: parts[3]}
+	}
+	if traceID != "" {
+		return &traceContext{TraceID: traceID, ParentSpanID: spanID, Flags: "01"}
+	}
+	return nil
+}
+
+// Generate a child span for the next HTTP call and return its traceparent
+func (t *traceContext) nextTraceParent() string {
+	t.Current = fmt.Sprintf("00-%s-%s-%s", t.TraceID, randomHex(8), t.Flags)
+	return t.Current
+}
+
+// Random lowercase hex string of n bytes, falling back to the clock if
+// the host provides no entropy source
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		nanos := uint64(time.Now().UnixNano())
+		for i := range buf {
+			buf[i] = byte(nanos >> (8 * uint(i%8)))
+		}
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Check that s is exactly n lowercase hex characters
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Trace and span ids must be lowercase hex and not all zeros
+func isTraceHex(s string, n int) bool {
+	return isLowerHex(s, n) && strings.Trim(s, "0") != ""
+}
+
+// Validate a traceparent, or a trace_id with an optional span_id; the two
+// forms are exclusive
+func validateTraceFields(traceParent, traceID, spanID string) error {
+	if traceParent != "" {
+		if traceID != "" || spanID != "" {
+			return fmt.Errorf("traceparent cannot be combined with trace_id or span_id")
+		}
+		return validateTraceParent(traceParent)
+	}
+	if traceID != "" && !isTraceHex(traceID, 32) {
+		return fmt.Errorf("trace_id must be 32 lowercase hex characters and not all zeros")
+	}
+	if spanID != "" {
+		if traceID == "" {
+			return fmt.Errorf("span_id requires trace_id")
+		}
+		if !isTraceHex(spanID, 16) {
+			return fmt.Errorf("span_id must be 16 lowercase hex characters and not all zeros")
+		}
+	}
+	return nil
+}
+
+// Response body files must be named, and since each one is emptied before
+// every request they must not be output.json or the file the input was
+// read from
+func validateResponsePaths(paths []string) error {
+	for _, path := range paths {
+		if strings.TrimSpace(path) == "" || path == outputFile {
+			return fmt.Errorf("response_paths entries must be file names other than output.json")
+		}
+		if activeInputPath != "" && path == activeInputPath {
+			return fmt.Errorf("response_paths must not include the input file %s", activeInputPath)
+		}
+	}
+	return nil
+}
+
+// Validate a W3C traceparent header value: version-traceid-spanid-flags
+func validateTraceParent(value string) error {
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 {
+		return fmt.Errorf("traceparent must have the form 00-<trace_id>-<span_id>-<flags>")
+	}
+	if parts[0] != "00" {
+		return fmt.Errorf("traceparent version must be 00")
+	}
+	if !isTraceHex(parts[1], 32) {
+		return fmt.Errorf("traceparent trace id must be 32 lowercase hex characters and not all zeros")
+	}
+	if !isTraceHex(parts[2], 16) {
+		return fmt.Errorf("traceparent span id must be 16 lowercase hex characters and not all zeros")
+	}
+	if !isLowerHex(parts[3], 2) {
+		return fmt.Errorf("traceparent flags must be 2 lowercase hex characters")
+	}
+	return nil
+}
+
+// Validate the Ollama server URL shared by all exports
+func validateOllamaURL(url string) error {
+	if url == "" {
+		return fmt.Errorf("ollama_url field is required")
+	}
+
+	// Validate URL format
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return fmt.Errorf("ollama_url must be a valid HTTP/HTTPS URL")
+	}
+	return nil
+}
+
+// Servers for a generation in failover order: ollama_urls when set,
+// otherwise ollama_url split on commas, without trailing slashes
+func ollamaURLList(input *OllamaInput) []string {
+	raw := input.OllamaURLs
+	if len(raw) == 0 {
+		raw = strings.Split(input.OllamaURL, ",")
+	}
+	var urls []string
+	for _, url := range raw {
+		if url = strings.TrimRight(strings.TrimSpace(url), "/"); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// Report whether a request got no HTTP response at all, which the host
+// signals with a status outside the HTTP range. Only these move a
+// generation on to the next server; any status from Ollama itself is
+// reported as is.
+func isConnectionFailure(err error) bool {
+	statusErr, ok := err.(*httpStatusError)
+	return ok && (statusErr.Status < 100 || statusErr.Status >= 600)
+}
+
+// Idempotency keys and request ids are 1-255 characters of letters,
+// digits and -_.: which covers UUIDs and ULIDs while keeping log lines
+// easy to search
+func validateIDToken(field, value string) error {
+	if len(value) > 255 {
+		return fmt.Errorf("%s exceeds maximum length of 255 characters", field)
+	}
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') &&
+			c != '-' && c != '_' && c != '.' && c != ':' {
+			return fmt.Errorf("%s may only contain letters, digits, '-', '_', '.' and ':'", field)
+		}
+	}
+	return nil
+}
+
+const defaultBlendSeparator = "\n\n---\n\n"
+
+// A {{...}} token in a prompt, capturing the variable name
+var templateTokenPattern = regexp.MustCompile(`\{\{\s*([^{}]*?)\s*\}\}`)
+
+// Replace each {{key}} token in text with its value in a single pass, so
+// substituted values are never scanned for tokens themselves. Returns the
+// result and the number of tokens replaced.
+func substituteTemplateVars(text string, vars map[string]string) (string, int) {
+	substitutions := 0
+	result := templateTokenPattern.ReplaceAllStringFunc(text, func(token string) string {
+		value, ok := vars[templateTokenPattern.FindStringSubmatch(token)[1]]
+		if !ok {
+			return token
+		}
+		substitutions++
+		return value
+	})
+	return result, substitutions
+}
+
+// List the distinct variable names of {{...}} tokens in texts that vars
+// does not provide, sorted
+func missingTemplateVars(vars map[string]string, texts ...string) []string {
+	seen := make(map[string]bool)
+	var missing []string
+	for _, text := range texts {
+		for _, match := range templateTokenPattern.FindAllStringSubmatch(text, -1) {
+			if _, ok := vars[match[1]]; ok {
+				continue
+			}
+			if !seen[match[1]] {
+				seen[match[1]] = true
+				missing = append(missing, match[1])
+			}
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// Combine weighted prompts into a single prompt. "concatenate" joins them
+// most important first; "meta" asks the model to weigh each one itself.
+func blendPrompts(prompts []WeightedPrompt, strategy, separator string) (string, error) {
+	weights := make([]float64, len(prompts))
+	total := 0.0
+	for i, p := range prompts {
+		if strings.TrimSpace(p.Text) == "" {
+			return "", fmt.Errorf("prompts[%d] text is required", i)
+		}
+		weights[i] = 1
+		if p.Weight != nil {
+			weights[i] = *p.Weight
+		}
+		if weights[i] < 0 || weights[i] > 100 {
+			return "", fmt.Errorf("prompts[%d] weight must be between 0 and 100", i)
+		}
+		total += weights[i]
+	}
+	if total <= 0 {
+		return "", fmt.Errorf("prompt weights must not all be zero")
+	}
+	if separator == "" {
+		separator = defaultBlendSeparator
+	}
+
+	// Most important prompts first; stable so equal weights keep their order
+	order := make([]int, len(prompts))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return weights[order[a]] > weights[order[b]] })
+
+	parts := make([]string, 0, len(prompts))
+	switch strategy {
+	case "", "concatenate":
+		for _, i := range order {
+			if weights[i] > 0 {
+				parts = append(parts, prompts[i].Text)
+			}
+		}
+		return strings.Join(parts, separator), nil
+	case "meta":
+		for _, i := range order {
+			if weights[i] > 0 {
+				parts = append(parts, fmt.Sprintf("Prompt %d (importance %.0f%%):\n%s", len(parts)+1, weights[i]/total*100, prompts[i].Text))
+			}
+		}
+		return "Respond to the following prompts as a single combined request. " +
+			"Give each prompt influence in proportion to its importance.\n\n" +
+			strings.Join(parts, separator), nil
+	default:
+		return "", fmt.Errorf("blend_strategy must be \"concatenate\" or \"meta\"")
+	}
+}
+
+// JSON schema types for the compact format_fields notation
+var formatFieldTypes = map[string]string{
+	"string":  "string",
+	"int":     "integer",
+	"integer": "integer",
+	"number":  "number",
+	"float":   "number",
+	"bool":    "boolean",
+	"boolean": "boolean",
+	"object":  "object",
+}
+
+// Expand format_fields such as {"name": "string!", "tags": "string[]"}
+// into an object schema with the "!" fields listed as required
+func expandFormatFields(fields map[string]string) (map[string]interface{}, error) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	properties := make(map[string]interface{}, len(fields))
+	required := []string{}
+	for _, name := range names {
+		if strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("format_fields names must not be empty")
+		}
+		spec := strings.TrimSpace(fields[name])
+		if strings.HasSuffix(spec, "!") {
+			required = append(required, name)
+			spec = strings.TrimSuffix(spec, "!")
+		}
+		isArray := strings.HasSuffix(spec, "[]")
+		spec = strings.TrimSuffix(spec, "[]")
+
+		jsonType, ok := formatFieldTypes[spec]
+		if !ok {
+			return nil, fmt.Errorf("format_fields.%s has unknown type %q", name, fields[name])
+		}
+		property := map[string]interface{}{"type": jsonType}
+		if isArray {
+			property = map[string]interface{}{"type": "array", "items": property}
+		}
+		properties[name] = property
+	}
+
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}, nil
+}
+
+// Validate input data according to schema requirements
+func validateInput(input *OllamaInput) error {
+	if input.Model == "" {
+		return fmt.Errorf("model field is required")
+	}
+
+	if input.Prompt == "" {
+		return fmt.Errorf("prompt field is required")
+	}
+
+	urls := ollamaURLList(input)
+	if len(urls) == 0 {
+		return validateOllamaURL("")
+	}
+	for _, url := range urls {
+		if err := validateOllamaURL(url); err != nil {
+			return err
+		}
+	}
+
+	// Validate prompt length
+	if len(input.Prompt) > 32768 {
+		return fmt.Errorf("prompt exceeds maximum length of 32768 characters")
+	}
+
+	// Validate system message length if provided
+	if input.System != "" && len(input.System) > 8192 {
+		return fmt.Errorf("system message exceeds maximum length of 8192 characters")
+	}
+
+	// Raw mode skips templating, so a system message or template would be
+	// silently ignored
+	if input.Raw {
+		if input.System != "" {
+			return fmt.Errorf("system cannot be combined with raw: true; include it in the prompt instead")
+		}
+		if input.Template != "" {
+			return fmt.Errorf("template cannot be combined with raw: true; apply it to the prompt instead")
+		}
+		if len(input.Context) > 0 {
+			logInfo("Raw mode request carries %d context tokens; a raw prompt is normally self-contained", len(input.Context))
+		}
+	}
+
+	// Models without fill-in-the-middle support ignore the suffix
+	if input.Suffix != "" && !looksFIMCapable(input.Model) {
+		logInfo("Model %s may not support fill-in-the-middle; the suffix may be ignored", input.Model)
+	}
+
+	// Validate trace context if provided
+	if err := validateTraceFields(input.TraceParent, input.TraceID, input.SpanID); err != nil {
+		return err
+	}
+
+	if input.MinResponseRatio < 0 || input.MaxResponseRatio < 0 {
+		return fmt.Errorf("response ratio bounds cannot be negative")
+	}
+	if input.MaxResponseRatio > 0 && input.MinResponseRatio > input.MaxResponseRatio {
+		return fmt.Errorf("min_response_ratio cannot exceed max_response_ratio")
+	}
+
+	for i, example := range input.FewShotExamples {
+		if strings.TrimSpace(example.Input) == "" || strings.TrimSpace(example.Output) == "" {
+			return fmt.Errorf("few_shot_examples[%d] must have both input and output", i)
+		}
+	}
+
+	if input.IdempotencyKey != "" {
+		if err := validateIDToken("idempotency_key", input.IdempotencyKey); err != nil {
+			return err
+		}
+	}
+
+	if input.RequestID != "" {
+		if err := validateIDToken("request_id", input.RequestID); err != nil {
+			return err
+		}
+	}
+
+	if input.MaxImageDimension < 0 {
+		return fmt.Errorf("max_image_dimension cannot be negative")
+	}
+	if input.MaxImages < 0 || input.MaxImageBytes < 0 {
+		return fmt.Errorf("max_images and max_image_bytes cannot be negative")
+	}
+	maxImages := input.MaxImages
+	if maxImages == 0 {
+		maxImages = defaultMaxImages
+	}
+	if len(input.Images) > maxImages {
+		return fmt.Errorf("images has %d entries, more than the maximum of %d", len(input.Images), maxImages)
+	}
+
+	for i, term := range input.BlockedTerms {
+		if strings.TrimSpace(term) == "" {
+			return fmt.Errorf("blocked_terms[%d] must not be empty", i)
+		}
+	}
+	if input.ExpectedPattern != "" {
+		if _, err := regexp.Compile(input.ExpectedPattern); err != nil {
+			return fmt.Errorf("expected_pattern is not a valid regular expression: %v", err)
+		}
+	}
+	if input.PatternMaxRetries != nil && (*input.PatternMaxRetries < 0 || *input.PatternMaxRetries > 10) {
+		return fmt.Errorf("pattern_max_retries must be between 0 and 10")
+	}
+	if input.ExtractPath != "" {
+		for _, segment := range strings.Split(input.ExtractPath, ".") {
+			if segment == "" {
+				return fmt.Errorf("extract_path must not have empty segments")
+			}
+		}
+	}
+	if input.PatternTemperatureStep < 0 {
+		return fmt.Errorf("pattern_temperature_step cannot be negative")
+	}
+	if input.EmptyMaxRetries != nil && (*input.EmptyMaxRetries < 0 || *input.EmptyMaxRetries > 10) {
+		return fmt.Errorf("empty_max_retries must be between 0 and 10")
+	}
+	if input.EmptyNumPredictStep < 0 {
+		return fmt.Errorf("empty_num_predict_step cannot be negative")
+	}
+
+	switch input.FilterMode {
+	case "", "redact", "flag":
+	default:
+		return fmt.Errorf("filter_mode must be \"redact\" or \"flag\"")
+	}
+
+	if input.KeepAlive != "" {
+		if _, _, err := parseKeepAlive(input.KeepAlive); err != nil {
+			return err
+		}
+	}
+
+	if err := validateRetrySettings(input.MaxRetries, input.RetryBackoffMs); err != nil {
+		return err
+	}
+
+	if input.EventLogPath != "" && (strings.TrimSpace(input.EventLogPath) == "" || input.EventLogPath == outputFile) {
+		return fmt.Errorf("event_log_path must be a file name other than output.json")
+	}
+
+	if input.APIPath != "" && !strings.HasPrefix(input.APIPath, "/") {
+		return fmt.Errorf("api_path must start with /")
+	}
+
+	if input.MaxRawResponseBytes < 0 {
+		return fmt.Errorf("max_raw_response_bytes must not be negative")
+	}
+
+	if input.StreamOutputPath != "" {
+		if input.Stream == nil || !*input.Stream {
+			return fmt.Errorf("stream_output_path requires stream: true")
+		}
+		if strings.TrimSpace(input.StreamOutputPath) == "" || input.StreamOutputPath == outputFile || input.StreamOutputPath == httpResponseFile {
+			return fmt.Errorf("stream_output_path must be a file name other than output.json and %s", httpResponseFile)
+		}
+		for _, path := range input.ResponsePaths {
+			if input.StreamOutputPath == path {
+				return fmt.Errorf("stream_output_path must not be one of response_paths")
+			}
+		}
+	}
+
+	if err := validateResponsePaths(input.ResponsePaths); err != nil {
+		return err
+	}
+	for _, path := range input.ResponsePaths {
+		switch path {
+		case input.EventLogPath:
+			return fmt.Errorf("response_paths must not include event_log_path")
+		case input.AliasFile:
+			return fmt.Errorf("response_paths must not include alias_file")
+		case input.CancelPath:
+			return fmt.Errorf("response_paths must not include cancel_path")
+		}
+	}
+
+	if input.MaxBadChunks != nil && *input.MaxBadChunks < 0 {
+		return fmt.Errorf("max_bad_chunks must not be negative")
+	}
+
+	if input.CancelPath != "" && (input.Stream == nil || !*input.Stream) {
+		return fmt.Errorf("cancel_path requires stream: true")
+	}
+
+	switch input.ResponseEncoding {
+	case "", "utf8", "base64":
+	default:
+		return fmt.Errorf("response_encoding must be \"utf8\" or \"base64\"")
+	}
+
+	if _, ok := logLevels[input.LogLevel]; input.LogLevel != "" && !ok {
+		return fmt.Errorf("log_level must be \"debug\", \"info\" or \"error\"")
+	}
+
+	for _, stop := range input.Stop {
+		if stop == "" {
+			return fmt.Errorf("stop sequences must not be empty")
+		}
+	}
+	if len(input.Stop) > 0 {
+		if _, err := stopSequences(input.Options["stop"]); err != nil {
+			return err
+		}
+	}
+
+	// At the error level a successful output's summary line would be dropped
+	if input.SkipOutputFile && input.LogLevel == "error" {
+		return fmt.Errorf("skip_output_file requires log_level \"debug\" or \"info\"")
+	}
+
+	return validateOptions(input.Options)
+}
+
+// Validate chat message roles and attached images
+func validateChatMessages(messages []ChatMessage) error {
+	for i, message := range messages {
+		switch message.Role {
+		case "system", "user", "assistant", "tool":
+		default:
+			return fmt.Errorf("messages[%d] has invalid role %q", i, message.Role)
+		}
+		if len(message.Images) > 0 {
+			if _, err := inspectImages(message.Images, imageLimits{}); err != nil {
+				return fmt.Errorf("messages[%d]: %v", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Parse a keep_alive value as Ollama does: a Go duration ("5m", "1h30m")
+// or a number of seconds ("300"). Negative values keep the model loaded
+// indefinitely and are normalized to "-1"; others to the duration's
+// canonical form. Seconds are -1 for indefinite.
+func parseKeepAlive(value string) (string, float64, error) {
+	value = strings.TrimSpace(value)
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, atoiErr := strconv.Atoi(value)
+		if atoiErr != nil {
+			return "", 0, fmt.Errorf("keep_alive %q is not a duration (e.g. \"5m\", \"1h30m\") or a number of seconds", value)
+		}
+		duration = time.Duration(seconds) * time.Second
+	}
+	if duration < 0 {
+		return "-1", -1, nil
+	}
+	return duration.String(), duration.Seconds(), nil
+}
+
+// Validate model options shared by generate and chat requests
+func validateOptions(options map[string]interface{}) error {
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		bounds, numeric := numericOptionRanges[key]
+		if !numeric {
+			if !ollamaOptionNames[key] {
+				logInfo("Unknown option %q will be ignored by the server", key)
+			}
+			continue
+		}
+		value, ok := options[key].(float64)
+		if !ok || (bounds.Integer && value != math.Trunc(value)) {
+			kind := "a number"
+			if bounds.Integer {
+				kind = "an integer"
+			}
+			return fmt.Errorf("option %s must be %s", key, kind)
+		}
+		if value < bounds.Min || value > bounds.Max {
+			if math.IsInf(bounds.Max, 1) {
+				return fmt.Errorf("option %s must be at least %g", key, bounds.Min)
+			}
+			return fmt.Errorf("option %s must be between %g and %g", key, bounds.Min, bounds.Max)
+		}
+	}
+
+	return nil
+}
+
+// Allowed range of a numeric model option
+type optionRange struct {
+	Min, Max float64
+	Integer  bool
+}
+
+// Numeric options whose type and range are validated
+var numericOptionRanges = map[string]optionRange{
+	"temperature":    {Min: 0, Max: 2},
+	"top_p":          {Min: 0, Max: 1},
+	"top_k":          {Min: 1, Max: math.Inf(1), Integer: true},
+	"seed":           {Min: math.Inf(-1), Max: math.Inf(1), Integer: true},
+	"num_predict":    {Min: -2, Max: math.Inf(1), Integer: true},
+	"num_ctx":        {Min: 1, Max: math.Inf(1), Integer: true},
+	"repeat_penalty": {Min: 0, Max: math.Inf(1)},
+}
+
+// Other options the server understands; anything else is logged as unknown
+var ollamaOptionNames = map[string]bool{
+	"num_keep": true, "min_p": true, "typical_p": true, "repeat_last_n": true,
+	"presence_penalty": true, "frequency_penalty": true, "penalize_newline": true,
+	"stop": true, "numa": true, "num_batch": true, "num_gpu": true, "main_gpu": true,
+	"use_mmap": true, "use_mlock": true, "num_thread": true, "low_vram": true,
+	"mirostat": true, "mirostat_tau": true, "mirostat_eta": true, "tfs_z": true,
+}
+
+// Return options with stop appended to any options.stop, skipping
+// sequences already present
+func withStopSequences(options map[string]interface{}, stop []string) map[string]interface{} {
+	if len(stop) == 0 {
+		return options
+	}
+	existing, _ := stopSequences(options["stop"])
+	seen := make(map[string]bool, len(existing)+len(stop))
+	merged := make([]interface{}, 0, len(existing)+len(stop))
+	for _, sequence := range append(existing, stop...) {
+		if !seen[sequence] {
+			seen[sequence] = true
+			merged = append(merged, sequence)
+		}
+	}
+
+	stopped := make(map[string]interface{}, len(options)+1)
+	for key, value := range options {
+		stopped[key] = value
+	}
+	stopped["stop"] = merged
+	return stopped
+}
+
+// Read options.stop, which may be unset, a string or an array of strings
+func stopSequences(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		sequences := make([]string, 0, len(v))
+		for _, item := range v {
+			sequence, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("option stop must be a string or an array of strings")
+			}
+			sequences = append(sequences, sequence)
+		}
+		return sequences, nil
+	}
+	return nil, fmt.Errorf("option stop must be a string or an array of strings")
+}
+
+// Return options with a seed, generating a random one when none is set so
+// the run can be reproduced from the recorded seed
+func withEffectiveSeed(options map[string]interface{}) (map[string]interface{}, int64, bool) {
+	if seed, ok := options["seed"].(float64); ok {
+		return options, int64(seed), false
+	}
+	random, _ := strconv.ParseUint(randomHex(4), 16, 32)
+	seed := int64(random & 0x7fffffff)
+
+	seeded := make(map[string]interface{}, len(options)+1)
+	for key, value := range options {
+		seeded[key] = value
+	}
+	seeded["seed"] = float64(seed)
+	return seeded, seed, true
+}
+
+// Model families trained for fill-in-the-middle completion
+var fimModelFamilies = []string{
+	"codellama", "codegemma", "codestral", "codeqwen", "deepseek-coder",
+	"granite-code", "qwen2.5-coder", "stable-code", "starcoder",
+}
+
+// Report whether a model name belongs to a known fill-in-the-middle family
+func looksFIMCapable(model string) bool {
+	name := strings.ToLower(model)
+	if slash := strings.LastIndex(name, "/"); slash >= 0 {
+		name = name[slash+1:]
+	}
+	for _, family := range fimModelFamilies {
+		if strings.HasPrefix(name, family) {
+			return true
+		}
+	}
+	return false
+}
+
+// Build metadata for the response
+func buildMetadata(input *OllamaInput, responseLength int) map[string]interface{} {
+	metadata := map[string]interface{}{
+		"input_prompt_length": len(input.Prompt),
+		"response_length":     responseLength,
+		"ollama_url":          input.OllamaURL,
+		"stream_mode":         input.Stream != nil && *input.Stream,
+		"processing_complete": true,
+		"go_version":          "tinygo",
+		"timestamp":           time.Now().Format(time.RFC3339),
+	}
+
+	if input.System != "" {
+		metadata["has_system_message"] = true
+		metadata["system_message_length"] = len(input.System)
+	}
+	if len(input.Images) > 0 {
+		metadata["image_count"] = len(input.Images)
+		metadata["multimodal_request"] = true
+	}
+	if input.Context != nil && len(input.Context) > 0 {
+		metadata["has_context"] = true
+		metadata["context_length"] = len(input.Context)
+	}
+	if input.Options != nil {
+		metadata["has_custom_options"] = true
+	}
+	if input.IdempotencyKey != "" {
+		metadata["idempotency_key"] = input.IdempotencyKey
+	}
+	if input.modelAlias != "" {
+		metadata["model_alias"] = input.modelAlias
+		metadata["resolved_model"] = input.Model
+	}
+	if input.formatExpanded {
+		metadata["expanded_schema"] = input.Format
+	}
+	if input.Suffix != "" {
+		metadata["fim_mode"] = true
+	}
+	if input.KeepAlive != "" {
+		metadata["keep_alive_seconds"] = input.keepAliveSeconds
+	}
+	if len(input.Prompts) > 0 {
+		strategy := input.BlendStrategy
+		if strategy == "" {
+			strategy = "concatenate"
+		}
+		metadata["blend_strategy"] = strategy
+		metadata["blended_prompt_count"] = len(input.Prompts)
+		metadata["combined_prompt_length"] = len(input.Prompt)
+	}
+
+	return metadata
+}
+
+const (
+	defaultMinResponseRatio = 0.01
+	defaultMaxResponseRatio = 100.0
+)
+
+// Round a ratio to four decimal places for metadata
+func roundRatio(value float64) float64 {
+	return float64(int64(value*10000+0.5)) / 10000
+}
+
+// Record response/prompt size ratios and flag values outside the band.
+// Token counts are preferred when the server reported them.
+func addRatioMetadata(output *OllamaOutput, input *OllamaInput) {
+	if len(input.Prompt) == 0 {
+		return
+	}
+	ratio := float64(len(output.Response)) / float64(len(input.Prompt))
+	output.Metadata["response_prompt_ratio_bytes"] = roundRatio(ratio)
+	if output.PromptEvalCount > 0 && output.EvalCount > 0 {
+		ratio = float64(output.EvalCount) / float64(output.PromptEvalCount)
+		output.Metadata["response_prompt_ratio_tokens"] = roundRatio(ratio)
+	}
+
+	minRatio, maxRatio := input.MinResponseRatio, input.MaxResponseRatio
+	if minRatio == 0 {
+		minRatio = defaultMinResponseRatio
+	}
+	if maxRatio == 0 {
+		maxRatio = defaultMaxResponseRatio
+	}
+	output.Metadata["suspicious_ratio"] = ratio < minRatio || ratio > maxRatio
+}
+
+const defaultMaxRawResponseBytes = 64 << 10
+
+// Store the response body in metadata, cut at a rune boundary when it is
+// longer than maxBytes
+func addRawResponseMetadata(metadata map[string]interface{}, body string, maxBytes int) {
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxRawResponseBytes
+	}
+	truncated := len(body) > maxBytes
+	if truncated {
+		cut := maxBytes
+		for cut > 0 && !utf8.RuneStart(body[cut]) {
+			cut--
+		}
+		body = body[:cut]
+	}
+	metadata["raw_response"] = body
+	metadata["raw_response_truncated"] = truncated
+}
+
+// Record generation and prompt evaluation rates in tokens per second,
+// rounded to two decimals; a rate is omitted when its counters are zero
+func addThroughputMetadata(output *OllamaOutput) {
+	if output.EvalCount > 0 && output.EvalDuration > 0 {
+		rate := float64(output.EvalCount) / (float64(output.EvalDuration) / 1e9)
+		output.Metadata["tokens_per_second"] = math.Round(rate*100) / 100
+	}
+	if output.PromptEvalCount > 0 && output.PromptEvalDuration > 0 {
+		rate := float64(output.PromptEvalCount) / (float64(output.PromptEvalDuration) / 1e9)
+		output.Metadata["prompt_tokens_per_second"] = math.Round(rate*100) / 100
+	}
+}
+
+const defaultContextWindow = 2048
+
+// Rough token estimate for English text (about four bytes per token)
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// Context window from options.num_ctx, or Ollama's default
+func contextWindow(options map[string]interface{}) int {
+	if numCtx, ok := options["num_ctx"].(float64); ok && numCtx > 0 {
+		return int(numCtx)
+	}
+	return defaultContextWindow
+}
+
+// Format few-shot examples ahead of the prompt, keeping as many examples as
+// fit into the context window next to the prompt itself. Returns the new
+// prompt and the number of examples injected.
+func injectFewShotExamples(prompt string, examples []FewShotExample, numCtx int) (string, int) {
+	budget := numCtx - estimateTokens(prompt)
+	var sb strings.Builder
+	injected := 0
+	for _, example := range examples {
+		block := fmt.Sprintf("Input: %s\nOutput: %s\n\n", example.Input, example.Output)
+		budget -= estimateTokens(block)
+		if budget < 0 {
+			break
+		}
+		sb.WriteString(block)
+		injected++
+	}
+	if injected == 0 {
+		return prompt, 0
+	}
+	sb.WriteString("Input: ")
+	sb.WriteString(prompt)
+	sb.WriteString("\nOutput:")
+	return sb.String(), injected
+}
+
+const (
+	defaultMaxImageDimension = 8192
+	defaultMaxImages         = 10
+	defaultMaxImageBytes     = 20 << 20
+)
+
+// Per-image limits for inspectImages; zero fields use the defaults
+type imageLimits struct {
+	MaxDimension int
+	MaxBytes     int
+}
+
+// Drop "data:image/png;base64," style prefixes so only the base64 payload
+// is decoded and sent
+func stripImagePrefixes(images []string) []string {
+	if images == nil {
+		return nil
+	}
+	stripped := make([]string, len(images))
+	for i, image := range images {
+		if strings.HasPrefix(image, "data:") {
+			if comma := strings.Index(image, ";base64,"); comma >= 0 {
+				image = image[comma+len(";base64,"):]
+			}
+		}
+		stripped[i] = image
+	}
+	return stripped
+}
+
+// Format and size of an attached image, read from its header
+type imageInfo struct {
+	Index  int    `json:"index"`
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// An image that failed inspection, with the error type to report
+type imageError struct {
+	Index     int
+	ErrorType string
+	Message   string
+}
+
+func (e *imageError) Error() string {
+	return e.Message
+}
+
+// Read width and height from a PNG's IHDR chunk
+func pngDimensions(data []byte) (int, int, bool) {
+	// 8-byte signature, 4-byte length, "IHDR", then width and height
+	if len(data) < 24 || string(data[12:16]) != "IHDR" {
+		return 0, 0, false
+	}
+	width := int(data[16])<<24 | int(data[17])<<16 | int(data[18])<<8 | int(data[19])
+	height := int(data[20])<<24 | int(data[21])<<16 | int(data[22])<<8 | int(data[23])
+	return width, height, true
+}
+
+// Read width and height from the first JPEG start-of-frame segment
+func jpegDimensions(data []byte) (int, int, bool) {
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return 0, 0, false
+		}
+		marker := data[i+1]
+		// Fill bytes and standalone markers carry no length
+		if marker == 0xFF {
+			i++
+			continue
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD8) {
+			i += 2
+			continue
+		}
+		length := int(data[i+2])<<8 | int(data[i+3])
+		// SOF0-SOF15, excluding DHT (C4), JPG (C8) and DAC (CC)
+		if marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC {
+			if i+9 > len(data) {
+				return 0, 0, false
+			}
+			height := int(data[i+5])<<8 | int(data[i+6])
+			width := int(data[i+7])<<8 | int(data[i+8])
+			return width, height, true
+		}
+		i += 2 + length
+	}
+	return 0, 0, false
+}
+
+// Decode each base64 image, check its size, detect PNG/JPEG and check its
+// dimensions
+func inspectImages(images []string, limits imageLimits) ([]imageInfo, error) {
+	maxDimension := limits.MaxDimension
+	if maxDimension == 0 {
+		maxDimension = defaultMaxImageDimension
+	}
+	maxBytes := limits.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultMaxImageBytes
+	}
+	infos := make([]imageInfo, 0, len(images))
+	for i, encoded := range images {
+		// DecodedLen overestimates by up to two padding bytes; check before
+		// allocating, then again on the exact size
+		if base64.StdEncoding.DecodedLen(len(encoded)) > maxBytes+2 {
+			return infos, &imageError{i, "VALIDATION_ERROR", fmt.Sprintf("images[%d] exceeds the maximum size of %d bytes", i, maxBytes)}
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return infos, &imageError{i, "VALIDATION_ERROR", fmt.Sprintf("images[%d] is not valid base64: %v", i, err)}
+		}
+		if len(data) > maxBytes {
+			return infos, &imageError{i, "VALIDATION_ERROR", fmt.Sprintf("images[%d] exceeds the maximum size of %d bytes", i, maxBytes)}
+		}
+
+		info := imageInfo{Index: i}
+		var ok bool
+		switch {
+		case len(data) >= 8 && string(data[:8]) == "\x89PNG\r\n\x1a\n":
+			info.Format = "png"
+			info.Width, info.Height, ok = pngDimensions(data)
+		case len(data) >= 3 && data[0] == 0xFF && data[1] == 0xD8 && data[2] == 0xFF:
+			info.Format = "jpeg"
+			info.Width, info.Height, ok = jpegDimensions(data)
+		default:
+			return infos, &imageError{i, "VALIDATION_ERROR", fmt.Sprintf("images[%d] is not a supported format (png or jpeg)", i)}
+		}
+		if !ok {
+			return infos, &imageError{i, "VALIDATION_ERROR", fmt.Sprintf("images[%d] has a corrupt %s header", i, info.Format)}
+		}
+		infos = append(infos, info)
+
+		if info.Width > maxDimension || info.Height > maxDimension {
+			return infos, &imageError{i, "IMAGE_DIMENSION_ERROR", fmt.Sprintf(
+				"images[%d] is %dx%d, exceeding the maximum dimension of %d pixels",
+				i, info.Width, info.Height, maxDimension,
+			)}
+		}
+	}
+	return infos, nil
+}
+
+// A blocked term found in the prompt or response
+type contentFlag struct {
+	Term     string `json:"term"`
+	Location string `json:"location"`
+	Count    int    `json:"count"`
+}
+
+// Build one case-insensitive matcher for all blocked terms. The regexp
+// alternation prefers its first matching branch, so longer terms come
+// first and "bad" cannot match ahead of "badword".
+func compileContentFilter(terms []string) *regexp.Regexp {
+	if len(terms) == 0 {
+		return nil
+	}
+	sorted := append([]string(nil), terms...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i]) > len(sorted[j])
+	})
+	quoted := make([]string, len(sorted))
+	for i, term := range sorted {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	return regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+}
+
+// Count blocked term matches in text, keyed by the term as configured
+func findContentFlags(filter *regexp.Regexp, terms []string, text, location string) []contentFlag {
+	if filter == nil {
+		return nil
+	}
+	counts := make(map[string]int)
+	for _, match := range filter.FindAllString(text, -1) {
+		for _, term := range terms {
+			if strings.EqualFold(match, term) {
+				counts[term]++
+				break
+			}
+		}
+	}
+	flags := make([]contentFlag, 0, len(counts))
+	for _, term := range terms {
+		if n, ok := counts[term]; ok {
+			flags = append(flags, contentFlag{Term: term, Location: location, Count: n})
+			delete(counts, term)
+		}
+	}
+	return flags
+}
+
+// Record the effective trace context of the last HTTP call
+func addTraceMetadata(metadata map[string]interface{}, trace *traceContext) {
+	if trace == nil || trace.Current == "" {
+		return
+	}
+	metadata["traceparent"] = trace.Current
+	metadata["trace_id"] = trace.TraceID
+	if trace.ParentSpanID != "" {
+		metadata["parent_span_id"] = trace.ParentSpanID
+	}
+}
+
+// Create error output with proper structure
+func createErrorOutput(errorMsg, errorType string, metadata map[string]interface{}) *OllamaOutput {
+	if metadata == nil {
+		metadata = make(map[string]interface{})
+	}
+	metadata["processing_complete"] = false
+	metadata["error_timestamp"] = time.Now().Format(time.RFC3339)
+
+	return &OllamaOutput{
+		Success:   false,
+		Error:     errorMsg,
+		ErrorType: errorType,
+		Done:      true,
+		Metadata:  metadata,
+	}
+}
+
+// Largest input accepted from the host (16MiB by default); a longer
+// inputLen is taken as a corrupted length and rejected before copying
+var maxInputSize uint32 = 16 << 20
+
+// Copy the host's input buffer after checking its length and pointer. A
+// uint32 pointer and length cannot be checked against the end of wasm32
+// linear memory from Go; an out-of-bounds read traps in the runtime.
+func copyInputBuffer(inputPtr, inputLen uint32) ([]byte, error) {
+	if inputLen == 0 {
+		return []byte{}, nil
+	}
+	if inputLen > maxInputSize {
+		return nil, fmt.Errorf("input length %d exceeds maximum of %d bytes", inputLen, maxInputSize)
+	}
+	if inputPtr == 0 {
+		return nil, fmt.Errorf("input pointer is null for %d bytes", inputLen)
+	}
+	inputBytes := make([]byte, inputLen)
+	copy(inputBytes, unsafe.Slice((*byte)(unsafe.Add(nil, inputPtr)), inputLen))
+	return inputBytes, nil
+}
+
+// Copy the input buffer passed by the host and decode it as JSON.
+// On failure an INPUT_PARSE_ERROR output is written and false returned.
+func readInput(inputPtr, inputLen uint32, target interface{}) bool {
+	activeInputPath = ""
+	inputBytes, err := copyInputBuffer(inputPtr, inputLen)
+	if err != nil {
+		logError("Invalid input buffer: %v", err)
+		writeError(
+			"INPUT_PARSE_ERROR",
+			fmt.Sprintf("Invalid input buffer: %v", err),
+			map[string]interface{}{
+				"error_stage": "input_reading",
+				"input_ptr":   inputPtr,
+				"input_size":  inputLen,
+			},
+		)
+		return false
+	}
+
+	return decodeInput(inputBytes, target)
+}
+
+// Read the input JSON from the file whose path the host passes in the
+// input buffer. On failure an INPUT_PARSE_ERROR output is written and
+// false returned.
+func readInputFile(pathPtr, pathLen uint32, target interface{}) bool {
+	activeInputPath = ""
+	pathBytes, err := copyInputBuffer(pathPtr, pathLen)
+	if err == nil && len(pathBytes) == 0 {
+		err = fmt.Errorf("input file path is empty")
+	}
+	if err != nil {
+		logError("Invalid input file path: %v", err)
+		writeError(
+			"INPUT_PARSE_ERROR",
+			fmt.Sprintf("Invalid input file path: %v", err),
+			map[string]interface{}{
+				"error_stage": "input_reading",
+				"input_ptr":   pathPtr,
+				"input_size":  pathLen,
+			},
+		)
+		return false
+	}
+
+	path := string(pathBytes)
+	inputBytes, err := readFloatFileBytes(path, maxInputSize)
+	if err != nil {
+		logError("Failed to read input file: %v", err)
+		writeError(
+			"INPUT_PARSE_ERROR",
+			fmt.Sprintf("Failed to read input file: %v", err),
+			map[string]interface{}{
+				"error_stage": "input_reading",
+				"input_path":  path,
+			},
+		)
+		return false
+	}
+	logInfo("Read %d bytes of input from %s", len(inputBytes), path)
+	activeInputPath = path
+	return decodeInput(inputBytes, target)
+}
+
+// Apply the input's log level and decode it as JSON. On failure an
+// INPUT_PARSE_ERROR output is written and false returned.
+func decodeInput(inputBytes []byte, target interface{}) bool {
+	setLogLevel(inputBytes)
+	setRequestID(inputBytes)
+	setRequestSettings(inputBytes)
+	if err := json.Unmarshal(inputBytes, target); err != nil {
+		logError("Failed to parse input JSON: %v", err)
+		writeError(
+			"INPUT_PARSE_ERROR",
+			fmt.Sprintf("Invalid input JSON: %v", err),
+			map[string]interface{}{
+				"error_stage": "input_parsing",
+				"input_size":  len(inputBytes),
+			},
+		)
+		return false
+	}
+	return true
+}
+
+const defaultGeneratePath = "/api/generate"
+
+// The generate endpoint path, honoring the api_path override
+func generatePath(input *OllamaInput) string {
+	if input.APIPath != "" {
+		return input.APIPath
+	}
+	return defaultGeneratePath
+}
+
+// Lowercase model name: an optional registry host[:port] prefix, one or
+// more path segments, then an optional :tag and an optional @digest
+var modelNamePattern = regexp.MustCompile(`^([a-z0-9.-]+(:[0-9]+)?/)?[a-z0-9._-]+(/[a-z0-9._-]+)*(:[a-z0-9._-]+)?(@[a-z0-9]+:[a-f0-9]+)?$`)
+
+// Lowercase a model name and add the :latest tag when it has neither a tag
+// nor a digest, so "Llama3" and "llama3:latest" name the same model. Only
+// the last path segment can carry the tag; a colon before it is a registry
+// port, as in "localhost:5000/ns/model".
+func normalizeModelName(model string) (string, error) {
+	name := strings.ToLower(strings.TrimSpace(model))
+	if !strings.Contains(name, "@") && !strings.Contains(name[strings.LastIndex(name, "/")+1:], ":") {
+		name += ":latest"
+	}
+	if !modelNamePattern.MatchString(name) {
+		return "", fmt.Errorf("model %q is not a valid model name; use lowercase letters, digits and . _ / - with an optional host:port/ prefix, :tag and @digest", model)
+	}
+	return name, nil
+}
+
+// Replace an alias from the alias file, a JSON object of alias to model
+// name, with the model it names. Other names are left unchanged.
+func resolveModelAlias(input *OllamaInput) error {
+	content, err := readFloatFileContent(input.AliasFile)
+	if err != nil {
+		return fmt.Errorf("failed to read alias_file: %v", err)
+	}
+	var aliases map[string]string
+	if err := json.Unmarshal([]byte(content), &aliases); err != nil {
+		return fmt.Errorf("alias_file %s must be a JSON object of alias to model name: %v", input.AliasFile, err)
+	}
+	model, ok := aliases[strings.TrimSpace(input.Model)]
+	if !ok {
+		return nil
+	}
+	if strings.TrimSpace(model) == "" {
+		return fmt.Errorf("alias %q in %s names no model", input.Model, input.AliasFile)
+	}
+	logInfo("Resolved model alias %q to %q", input.Model, model)
+	input.modelAlias = input.Model
+	input.Model = model
+	return nil
+}
+
+// Report whether model, in normalized form, is installed on the server
+func modelInstalled(models []ModelInfo, model string) bool {
+	for _, installed := range models {
+		if name, err := normalizeModelName(installed.Name); err == nil && name == model {
+			return true
+		}
+	}
+	return false
+}
+
+// A validated /api/generate request, ready to send
+type preparedGeneration struct {
+	URL             string
+	Request         OllamaAPIRequest
+	Body            []byte
+	Images          []imageInfo
+	FewShotInjected int
+	ContentFilter   *regexp.Regexp
+	Seed            int64
+	SeedGenerated   bool
+	EstimatedTokens int
+	ContextWindow   int
+}
+
+// Validate the input and assemble the exact request that would be sent.
+// On failure the error output to write is returned instead.
+func prepareGeneration(input *OllamaInput) (*preparedGeneration, *OllamaOutput) {
+	// Blend weighted prompts into the prompt that is validated and sent
+	if len(input.Prompts) > 0 && !input.promptsBlended {
+		combined, err := blendPrompts(input.Prompts, input.BlendStrategy, input.BlendSeparator)
+		if err == nil && input.Prompt != "" {
+			err = fmt.Errorf("prompt and prompts cannot both be set")
+		}
+		if err != nil {
+			logError("Input validation failed: %v", err)
+			return nil, createErrorOutput(err.Error(), "VALIDATION_ERROR", map[string]interface{}{
+				"error_stage": "validation",
+				"model":       input.Model,
+			})
+		}
+		input.Prompt = combined
+		input.promptsBlended = true
+	}
+
+	// Substitute template variables into the prompt and system prompt
+	if len(input.TemplateVars) > 0 && !input.templateApplied {
+		if missing := missingTemplateVars(input.TemplateVars, input.Prompt, input.System); len(missing) > 0 {
+			logError("Input validation failed: unresolved template variables %v", missing)
+			return nil, createErrorOutput(
+				fmt.Sprintf("template variables not provided: %s", strings.Join(missing, ", ")),
+				"VALIDATION_ERROR",
+				map[string]interface{}{
+					"error_stage":       "validation",
+					"model":             input.Model,
+					"missing_variables": missing,
+				},
+			)
+		}
+		prompt, promptSubstitutions := substituteTemplateVars(input.Prompt, input.TemplateVars)
+		system, systemSubstitutions := substituteTemplateVars(input.System, input.TemplateVars)
+		input.Prompt = prompt
+		input.System = system
+		input.templateSubstitutions = promptSubstitutions + systemSubstitutions
+		input.templateApplied = true
+	}
+
+	// Expand the compact field schema into a JSON schema
+	if len(input.FormatFields) > 0 && !input.formatExpanded {
+		schema, err := expandFormatFields(input.FormatFields)
+		if err == nil && input.Format != nil {
+			err = fmt.Errorf("format and format_fields cannot both be set")
+		}
+		if err != nil {
+			logError("Input validation failed: %v", err)
+			return nil, createErrorOutput(err.Error(), "VALIDATION_ERROR", map[string]interface{}{
+				"error_stage": "validation",
+				"model":       input.Model,
+			})
+		}
+		input.Format = schema
+		input.formatExpanded = true
+	}
+
+	// Ask for JSON, leaving an explicit format and raw prompts alone
+	if input.ForceJSON && !input.jsonForced {
+		if input.Format == nil {
+			input.Format = "json"
+		}
+		if !input.Raw && !strings.Contains(strings.ToLower(input.System), "json") {
+			input.System = strings.TrimSpace(input.System + "\n\n" + forceJSONInstruction)
+		}
+		input.jsonForced = true
+	}
+
+	// Translate a friendly model name before it is validated
+	if input.AliasFile != "" && !input.aliasResolved {
+		if err := resolveModelAlias(input); err != nil {
+			logError("Input validation failed: %v", err)
+			return nil, createErrorOutput(err.Error(), "VALIDATION_ERROR", map[string]interface{}{
+				"error_stage": "validation",
+				"model":       input.Model,
+				"alias_file":  input.AliasFile,
+			})
+		}
+		input.aliasResolved = true
+	}
+
+	// Validate input
+	if err := validateInput(input); err != nil {
+		logError("Input validation failed: %v", err)
+		errorType := "VALIDATION_ERROR"
+		metadata := map[string]interface{}{
+			"error_stage": "validation",
+			"model":       input.Model,
+		}
+
+		if strings.Contains(err.Error(), "model") {
+			metadata["missing_field"] = "model"
+		} else if strings.Contains(err.Error(), "prompt") {
+			metadata["missing_field"] = "prompt"
+		} else if strings.Contains(err.Error(), "ollama_url") {
+			metadata["missing_field"] = "ollama_url"
+		}
+
+		return nil, createErrorOutput(err.Error(), errorType, metadata)
+	}
+
+	// Send the model in canonical form so the server finds the loaded copy
+	normalizedModel, err := normalizeModelName(input.Model)
+	if err != nil {
+		logError("Input validation failed: %v", err)
+		return nil, createErrorOutput(err.Error(), "VALIDATION_ERROR", map[string]interface{}{
+			"error_stage": "validation",
+			"model":       input.Model,
+		})
+	}
+	if normalizedModel != input.Model {
+		logInfo("Normalized model %q to %q", input.Model, normalizedModel)
+		input.Model = normalizedModel
+	}
+
+	// Validate attached images, sending them without any data URL prefix
+	input.Images = stripImagePrefixes(input.Images)
+	images, err := inspectImages(input.Images, imageLimits{
+		MaxDimension: input.MaxImageDimension,
+		MaxBytes:     input.MaxImageBytes,
+	})
+	if err != nil {
+		logError("Image validation failed: %v", err)
+		imgErr := err.(*imageError)
+		return nil, createErrorOutput(err.Error(), imgErr.ErrorType, map[string]interface{}{
+			"error_stage": "validation",
+			"model":       input.Model,
+			"image_index": imgErr.Index,
+			"images":      images,
+		})
+	}
+
+	// Reject prompts containing blocked terms before anything is sent
+	contentFilter := compileContentFilter(input.BlockedTerms)
+	promptFlags := append(
+		findContentFlags(contentFilter, input.BlockedTerms, input.Prompt, "prompt"),
+		findContentFlags(contentFilter, input.BlockedTerms, input.System, "system")...,
+	)
+	if len(promptFlags) > 0 {
+		logError("Input validation failed: %d blocked terms in prompt", len(promptFlags))
+		return nil, createErrorOutput("prompt contains blocked terms", "VALIDATION_ERROR", map[string]interface{}{
+			"error_stage":   "validation",
+			"model":         input.Model,
+			"content_flags": promptFlags,
+		})
+	}
+
+	logInfo("Input validation passed")
+
+	if input.KeepAlive != "" {
+		input.KeepAlive, input.keepAliveSeconds, _ = parseKeepAlive(input.KeepAlive)
+	}
+
+	// Ensure URLs don't end with slash for consistent API calls; the
+	// first server stands for the list everywhere but the request itself
+	if input.ollamaURLs == nil {
+		input.ollamaURLs = ollamaURLList(input)
+		input.OllamaURL = input.ollamaURLs[0]
+	}
+
+	// A name that is not an alias has to be a real model. Dry runs send
+	// nothing, so they skip the check.
+	if input.AliasFile != "" && input.modelAlias == "" && !input.modelChecked && !input.DryRun {
+		httpOpts := requestOptionsFromInput(input)
+		models, err := fetchInstalledModels(input.OllamaURL, httpOpts)
+		if err != nil {
+			return nil, modelRequestFailureOutput(err, input.OllamaURL+"/api/tags", input.Model, httpOpts.Attempts-1, httpOpts, "")
+		}
+		if !modelInstalled(models, input.Model) {
+			logError("Input validation failed: model %s is neither an alias nor installed", input.Model)
+			return nil, createErrorOutput(
+				fmt.Sprintf("model %q is neither an alias in %s nor installed on the server", input.Model, input.AliasFile),
+				"VALIDATION_ERROR",
+				map[string]interface{}{
+					"error_stage": "validation",
+					"model":       input.Model,
+					"alias_file":  input.AliasFile,
+				},
+			)
+		}
+		input.modelChecked = true
+	}
+
+	// Set stream to false if not specified (ensure complete response)
+	if input.Stream == nil {
+		streamFalse := false
+		input.Stream = &streamFalse
+	}
+
+	prompt := input.Prompt
+	fewShotInjected := 0
+	if len(input.FewShotExamples) > 0 {
+		prompt, fewShotInjected = injectFewShotExamples(prompt, input.FewShotExamples, contextWindow(input.Options))
+		logInfo("Injected %d of %d few-shot examples", fewShotInjected, len(input.FewShotExamples))
+	}
+
+	// The server silently truncates a prompt that overflows num_ctx, so
+	// only warn about it
+	estimatedTokens := estimateTokens(prompt) + estimateTokens(input.System) + len(input.Context)
+	numCtx := contextWindow(input.Options)
+	if estimatedTokens > numCtx {
+		logInfo("Estimated %d prompt tokens exceed the %d token context window; the prompt may be truncated", estimatedTokens, numCtx)
+	}
+
+	// Prepare Ollama API request
+	options, seed, seedGenerated := withEffectiveSeed(withStopSequences(input.Options, input.Stop))
+	apiRequest := OllamaAPIRequest{
+		Model:     input.Model,
+		Prompt:    prompt,
+		System:    input.System,
+		Template:  input.Template,
+		Context:   input.Context,
+		Stream:    input.Stream,
+		Raw:       input.Raw,
+		Format:    input.Format,
+		Options:   options,
+		Suffix:    input.Suffix,
+		KeepAlive: input.KeepAlive,
+		Images:    input.Images,
+	}
+
+	// Marshal request body
+	requestBody, err := json.Marshal(apiRequest)
+	if err != nil {
+		logError("Failed to marshal request: %v", err)
+		return nil, createErrorOutput(
+			fmt.Sprintf("Failed to prepare request: %v", err),
+			"REQUEST_MARSHAL_ERROR",
+			map[string]interface{}{
+				"error_stage": "request_preparation",
+				"model":       input.Model,
+			},
+		)
+	}
+
+	logInfo("Prepared request body (%d bytes)", len(requestBody))
+
+	return &preparedGeneration{
+		URL:             input.OllamaURL + generatePath(input),
+		Request:         apiRequest,
+		Body:            requestBody,
+		Images:          images,
+		FewShotInjected: fewShotInjected,
+		ContentFilter:   contentFilter,
+		Seed:            seed,
+		SeedGenerated:   seedGenerated,
+		EstimatedTokens: estimatedTokens,
+		ContextWindow:   numCtx,
+	}, nil
+}
+
+// Validate the input, call /api/generate and build the output. Errors are
+// returned as error outputs from createErrorOutput so callers that make
+// several generations can inspect them before deciding what to write.
+func runGeneration(input *OllamaInput) *OllamaOutput {
+	prepared, failed := prepareGeneration(input)
+	if failed != nil {
+		if failed.Metadata["error_stage"] == "validation" {
+			input.events.record("validation", "error", failed.Error)
+		} else {
+			input.events.record("validation", "ok", "")
+			input.events.record("request_built", "error", failed.Error)
+		}
+		return failed
+	}
+	input.events.record("validation", "ok", "")
+	input.events.record("request_built", "ok", fmt.Sprintf("%d bytes", len(prepared.Body)))
+
+	httpOpts := requestOptionsFromInput(input)
+
+	if cancelRequested(input.CancelPath) {
+		input.events.record("request_sent", "cancelled", input.CancelPath)
+		logInfo("Generation cancelled before the request was sent")
+		output := createErrorOutput("Generation cancelled before the request was sent", "CANCELLED", map[string]interface{}{
+			"error_stage":   "cancellation",
+			"stream_mode":   true,
+			"stream_chunks": 0,
+			"cancel_path":   input.CancelPath,
+		})
+		output.Model = input.Model
+		return output
+	}
+
+	// Make HTTP request to Ollama, failing over to the next server only
+	// when one cannot be reached at all. The preflight check runs on the
+	// server being tried, so an unreachable one fails over there as well.
+	url := prepared.URL
+	servedBy := input.OllamaURL
+	var responseBody string
+	var err error
+	attempts := 0
+	for i, baseURL := range input.ollamaURLs {
+		servedBy = baseURL
+
+		// Confirm the model is installed on this server; retries against
+		// the same server reuse the result
+		if input.PreflightCheck && (input.preflightInfo == nil || input.preflightURL != baseURL) {
+			logInfo("Running preflight check for model %s on %s", input.Model, baseURL)
+			info, preflightErr := fetchModelInfo(baseURL, input.Model, httpOpts)
+			if isConnectionFailure(preflightErr) && i < len(input.ollamaURLs)-1 {
+				logInfo("Ollama server %s is unreachable (%v), failing over to %s", baseURL, preflightErr, input.ollamaURLs[i+1])
+				continue
+			}
+			if preflightErr != nil {
+				return preflightErrorOutput(input, baseURL, preflightErr)
+			}
+			input.preflightInfo = info
+			input.preflightURL = baseURL
+			input.events.record("preflight", "ok", info.Details.ParameterSize)
+		}
+
+		url = baseURL + generatePath(input)
+		logInfo("Making request to Ollama API: %s", url)
+
+		responseBody, err = makeHttpRequest(url, "POST", string(prepared.Body), httpOpts)
+		attempts += httpOpts.Attempts
+		if !isConnectionFailure(err) || i == len(input.ollamaURLs)-1 {
+			break
+		}
+		logInfo("Ollama server %s is unreachable (%v), failing over to %s", baseURL, err, input.ollamaURLs[i+1])
+	}
+	if err != nil {
+		input.events.record("request_sent", "error", err.Error())
+		return modelRequestFailureOutput(err, url, input.Model, attempts-1, httpOpts, "wrong URL or model not installed; check ollama_url and api_path")
+	}
+
+	logInfo("HTTP request completed successfully")
+	input.events.record("request_sent", "ok", url)
+
+	// Parse Ollama response; streamed responses arrive as NDJSON chunks
+	maxBadChunks := defaultMaxBadChunks
+	if *input.Stream && input.MaxBadChunks != nil {
+		maxBadChunks = *input.MaxBadChunks
+	}
+	decoded, streamChunks, skippedChunks, failed := decodeModelResponse(responseBody, *input.Stream, maxBadChunks)
+	if failed != nil {
+		input.events.record("response_received", "error", failed.Error)
+		return failed
+	}
+	apiResponse := decoded.OllamaAPIResponse
+
+	// The body arrives in one piece and the host can only replace whole
+	// files, so the streamed text is written once, after decoding
+	streamOutputWritten := false
+	if input.StreamOutputPath != "" {
+		if err := writeFloatFile(input.StreamOutputPath, []byte(apiResponse.Response)); err != nil {
+			logError("Failed to write stream output: %v", err)
+		} else {
+			streamOutputWritten = true
+		}
+	}
+
+	logInfo("Successfully parsed Ollama response (%d characters)", len(apiResponse.Response))
+	input.events.record("response_received", "ok", fmt.Sprintf("%d characters", len(apiResponse.Response)))
+
+	// Build successful output
+	output := &OllamaOutput{
+		Success:            true,
+		Response:           apiResponse.Response,
+		Model:              apiResponse.Model,
+		CreatedAt:          apiResponse.CreatedAt,
+		Done:               apiResponse.Done,
+		DoneReason:         apiResponse.DoneReason,
+		Context:            apiResponse.Context,
+		TotalDuration:      apiResponse.TotalDuration,
+		LoadDuration:       apiResponse.LoadDuration,
+		PromptEvalCount:    apiResponse.PromptEvalCount,
+		PromptEvalDuration: apiResponse.PromptEvalDuration,
+		EvalCount:          apiResponse.EvalCount,
+		EvalDuration:       apiResponse.EvalDuration,
+		Metadata:           buildMetadata(input, len(apiResponse.Response)),
+	}
+	addTraceMetadata(output.Metadata, httpOpts.Trace)
+	addRatioMetadata(output, input)
+	addThroughputMetadata(output)
+	if input.preflightInfo != nil {
+		output.Metadata["model_parameter_size"] = input.preflightInfo.Details.ParameterSize
+		output.Metadata["model_quantization_level"] = input.preflightInfo.Details.QuantizationLevel
+	}
+	output.Metadata["retry_count"] = attempts - 1
+	output.Metadata["served_by"] = servedBy
+	output.Metadata["ollama_url"] = servedBy
+	output.Metadata["response_compressed"] = httpOpts.Compressed
+	addLatencyMetadata(output.Metadata, httpOpts)
+	if streamChunks > 0 {
+		output.Metadata["stream_chunks"] = streamChunks
+		output.Metadata["skipped_chunks"] = skippedChunks
+	}
+	if input.StreamOutputPath != "" {
+		output.Metadata["stream_output_path"] = input.StreamOutputPath
+		output.Metadata["stream_output_written"] = streamOutputWritten
+	}
+
+	// Token accounting for this call and the session so far
+	output.Usage = &TokenUsage{
+		PromptTokens:     apiResponse.PromptEvalCount,
+		CompletionTokens: apiResponse.EvalCount,
+		TotalTokens:      apiResponse.PromptEvalCount + apiResponse.EvalCount,
+	}
+	output.TotalTokens = output.Usage.TotalTokens
+	sessionUsage.Add(*output.Usage)
+	output.Metadata["session_usage"] = sessionUsage
+
+	// Check the response against the requested format before any redaction
+	if input.Format != nil {
+		if formatErr := validateResponseFormat(output.Response, input.Format); formatErr != nil {
+			logError("Response does not match requested format: %v", formatErr)
+			output.Metadata["format_valid"] = false
+			if _, isSchema := input.Format.(map[string]interface{}); isSchema {
+				output.Error = formatErr.Error()
+				output.ErrorType = "FORMAT_VALIDATION_ERROR"
+			}
+		} else {
+			output.Metadata["format_valid"] = true
+		}
+	}
+
+	// Filter blocked terms out of the response
+	contentFilter := prepared.ContentFilter
+	redacting := contentFilter != nil && input.FilterMode != "flag"
+	if responseFlags := findContentFlags(contentFilter, input.BlockedTerms, output.Response, "response"); len(responseFlags) > 0 {
+		if redacting {
+			output.Response = contentFilter.ReplaceAllString(output.Response, "[REDACTED]")
+		}
+		output.Metadata["content_flags"] = responseFlags
+		logInfo("Response contained %d blocked terms", len(responseFlags))
+	}
+
+	// The raw body gets the same redaction. A term split across stream
+	// chunks cannot be matched in the NDJSON, so a streamed body is left
+	// out instead.
+	if input.IncludeRawResponse {
+		switch {
+		case redacting && streamChunks > 0:
+			logInfo("Omitting raw_response: blocked terms cannot be redacted reliably from a streamed body")
+			output.Metadata["raw_response_omitted"] = true
+		case redacting:
+			addRawResponseMetadata(output.Metadata, contentFilter.ReplaceAllString(responseBody, "[REDACTED]"), input.MaxRawResponseBytes)
+		default:
+			addRawResponseMetadata(output.Metadata, responseBody, input.MaxRawResponseBytes)
+		}
+	}
+
+	// Pull the requested field out of the redacted JSON response; a
+	// missing path or a response that is not JSON is noted rather than
+	// failing
+	if input.ExtractPath != "" {
+		value, found := extractJSONPath(output.Response, input.ExtractPath)
+		output.Metadata["extracted_value"] = value
+		if !found {
+			logInfo("extract_path %q not found in the response", input.ExtractPath)
+			output.Metadata["extract_miss"] = true
+		}
+	}
+	addPreparationMetadata(output.Metadata, prepared, input)
+
+	return output
+}
+
+// Error output for a failed preflight check: a 404 means the model is not
+// installed on the server
+func preflightErrorOutput(input *OllamaInput, baseURL string, err error) *OllamaOutput {
+	input.events.record("preflight", "error", err.Error())
+	metadata := map[string]interface{}{
+		"error_stage": "preflight",
+		"ollama_url":  baseURL + "/api/show",
+		"model":       input.Model,
+	}
+	if statusErr, ok := err.(*httpStatusError); ok && statusErr.Status == 404 {
+		return createErrorOutput(
+			fmt.Sprintf("Model %q is not installed on the server; run 'ollama pull %s' first", input.Model, input.Model),
+			"MODEL_NOT_FOUND",
+			metadata,
+		)
+	}
+	if _, ok := err.(*httpStatusError); ok {
+		return httpRequestErrorOutput(err, metadata, "")
+	}
+	return createErrorOutput(
+		fmt.Sprintf("Preflight check failed: %v", err),
+		"HTTP_REQUEST_ERROR",
+		metadata,
+	)
+}
+
+// A stream line that is not a valid /api/generate chunk
+type streamLineError struct {
+	Line       string
+	LineNumber int
+	Err        error
+}
+
+func (e *streamLineError) Error() string {
+	return fmt.Sprintf("invalid stream chunk on line %d: %v", e.LineNumber, e.Err)
+}
+
+// Splits data arriving in arbitrary pieces into lines. An incomplete
+// trailing line is held back until the next write, and flush hands over
+// whatever is left even without a final newline. Blank lines are skipped.
+type lineSplitter struct {
+	pending string
+	lines   int
+}
+
+// Feed the next piece of data, calling handle for every complete line
+func (s *lineSplitter) write(data string, handle func(line string, number int) error) error {
+	s.pending += data
+	for {
+		newline := strings.IndexByte(s.pending, '\n')
+		if newline < 0 {
+			return nil
+		}
+		line := s.pending[:newline]
+		s.pending = s.pending[newline+1:]
+		if err := s.emit(line, handle); err != nil {
+			return err
+		}
+	}
+}
+
+// Hand over the last line if it had no trailing newline
+func (s *lineSplitter) flush(handle func(line string, number int) error) error {
+	if s.pending == "" {
+		return nil
+	}
+	line := s.pending
+	s.pending = ""
+	return s.emit(line, handle)
+}
+
+func (s *lineSplitter) emit(line string, handle func(line string, number int) error) error {
+	s.lines++
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+	return handle(line, s.lines)
+}
+
+const defaultMaxBadChunks = 3
+
+// Decodes a newline-delimited /api/generate or /api/chat stream. Up to
+// maxBadChunks lines that are not JSON are skipped.
+type streamAccumulator struct {
+	splitter     lineSplitter
+	chunks       int
+	skipped      int
+	maxBadChunks int
+	response     strings.Builder
+	final        *ChatAPIResponse
+}
+
+// Feed the next piece of the stream
+func (a *streamAccumulator) write(data string) error {
+	return a.splitter.write(data, a.decodeLine)
+}
+
+func (a *streamAccumulator) decodeLine(line string, number int) error {
+	var chunk ChatAPIResponse
+	if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+		if a.skipped < a.maxBadChunks {
+			a.skipped++
+			logError("Skipping malformed stream chunk on line %d: %v", number, err)
+			return nil
+		}
+		return &streamLineError{Line: line, LineNumber: number, Err: err}
+	}
+	a.chunks++
+	a.response.WriteString(chunk.Response)
+	a.response.WriteString(chunk.Message.Content)
+	if chunk.Done {
+		a.final = &chunk
+	}
+	return nil
+}
+
+// Decode the last line and return the aggregated response: the text of
+// all chunks (in both Response and Message.Content) with the context,
+// counts and durations of the done chunk
+func (a *streamAccumulator) close() (*ChatAPIResponse, error) {
+	if err := a.splitter.flush(a.decodeLine); err != nil {
+		return nil, err
+	}
+	if a.final == nil {
+		return nil, fmt.Errorf("stream ended after %d chunks without a done chunk", a.chunks)
+	}
+	result := *a.final
+	result.Response = a.response.String()
+	result.Message.Content = result.Response
+	if result.Message.Role == "" {
+		result.Message.Role = "assistant"
+	}
+	return &result, nil
+}
+
+// Aggregate a complete NDJSON response body. Returns the numbers of
+// chunks decoded and malformed chunks skipped.
+func parseStreamResponse(body string, maxBadChunks int) (*ChatAPIResponse, int, int, error) {
+	stream := streamAccumulator{maxBadChunks: maxBadChunks}
+	if err := stream.write(body); err != nil {
+		return nil, stream.chunks, stream.skipped, err
+	}
+	response, err := stream.close()
+	return response, stream.chunks, stream.skipped, err
+}
+
+// Keep the system messages and the last max other messages, in order. A
+// kept history starting with an assistant reply also drops that reply,
+// so the model sees whole exchanges. Returns the kept messages and the
+// number dropped.
+func trimChatHistory(messages []ChatMessage, max int) ([]ChatMessage, int) {
+	var history []int
+	for i, message := range messages {
+		if message.Role != "system" {
+			history = append(history, i)
+		}
+	}
+	if len(history) <= max {
+		return messages, 0
+	}
+	history = history[len(history)-max:]
+	for len(history) > 1 && messages[history[0]].Role != "user" {
+		history = history[1:]
+	}
+
+	keep := make(map[int]bool, len(history))
+	for _, i := range history {
+		keep[i] = true
+	}
+	trimmed := make([]ChatMessage, 0, len(messages))
+	for i, message := range messages {
+		if message.Role == "system" || keep[i] {
+			trimmed = append(trimmed, message)
+		}
+	}
+	return trimmed, len(messages) - len(trimmed)
+}
+
+// Validate a chat input, call /api/chat and build the output
+func runChat(input *ChatInput) *OllamaOutput {
+	var validationErr error
+	switch {
+	case input.Model == "":
+		validationErr = fmt.Errorf("model field is required")
+	case len(input.Messages) == 0:
+		validationErr = fmt.Errorf("messages must contain at least one message")
+	case input.Suffix != "":
+		validationErr = fmt.Errorf("suffix is not supported by the chat API; use generate_ollama with prompt and suffix")
+	default:
+		validationErr = validateOllamaURL(input.OllamaURL)
+	}
+	for i := range input.Messages {
+		input.Messages[i].Images = stripImagePrefixes(input.Messages[i].Images)
+	}
+	if validationErr == nil {
+		validationErr = validateChatMessages(input.Messages)
+	}
+	if validationErr == nil && input.MaxHistoryMessages < 0 {
+		validationErr = fmt.Errorf("max_history_messages must not be negative")
+	}
+	if validationErr == nil {
+		validationErr = validateOptions(input.Options)
+	}
+	keepAliveSeconds := 0.0
+	if validationErr == nil && input.KeepAlive != "" {
+		input.KeepAlive, keepAliveSeconds, validationErr = parseKeepAlive(input.KeepAlive)
+	}
+	normalizedModel := input.Model
+	if validationErr == nil {
+		normalizedModel, validationErr = normalizeModelName(input.Model)
+	}
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return createErrorOutput(validationErr.Error(), "VALIDATION_ERROR", map[string]interface{}{
+			"error_stage": "validation",
+			"model":       input.Model,
+		})
+	}
+	if normalizedModel != input.Model {
+		logInfo("Normalized model %q to %q", input.Model, normalizedModel)
+		input.Model = normalizedModel
+	}
+
+	input.OllamaURL = strings.TrimRight(input.OllamaURL, "/")
+	if input.Stream == nil {
+		streamFalse := false
+		input.Stream = &streamFalse
+	}
+
+	trimmedMessages := 0
+	if input.MaxHistoryMessages > 0 {
+		input.Messages, trimmedMessages = trimChatHistory(input.Messages, input.MaxHistoryMessages)
+		if trimmedMessages > 0 {
+			logInfo("Trimmed %d older messages from the chat history", trimmedMessages)
+		}
+	}
+
+	requestBody, err := json.Marshal(ChatAPIRequest{
+		Model:     input.Model,
+		Messages:  input.Messages,
+		Stream:    input.Stream,
+		Format:    input.Format,
+		Options:   input.Options,
+		KeepAlive: input.KeepAlive,
+	})
+	if err != nil {
+		logError("Failed to marshal request: %v", err)
+		return createErrorOutput(
+			fmt.Sprintf("Failed to prepare request: %v", err),
+			"REQUEST_MARSHAL_ERROR",
+			map[string]interface{}{
+				"error_stage": "request_preparation",
+				"model":       input.Model,
+			},
+		)
+	}
+
+	url := input.OllamaURL + "/api/chat"
+	logInfo("Making request to Ollama API: %s", url)
+	httpOpts := newRequestOptions()
+	responseBody, err := makeHttpRequest(url, "POST", string(requestBody), httpOpts)
+	if err != nil {
+		return modelRequestFailureOutput(err, url, input.Model, httpOpts.Attempts-1, httpOpts, "wrong URL or model not installed; check ollama_url")
+	}
+
+	// Stream cancellation and the malformed chunk budget are generate_ollama
+	// settings, so a chat stream fails on its first bad chunk
+	decoded, streamChunks, _, failed := decodeModelResponse(responseBody, *input.Stream, 0)
+	if failed != nil {
+		return failed
+	}
+	chatResponse := *decoded
+
+	content := chatResponse.Message.Content
+	logInfo("Successfully parsed chat response (%d characters)", len(content))
+
+	output := &OllamaOutput{
+		Success:            true,
+		Response:           content,
+		Model:              chatResponse.Model,
+		CreatedAt:          chatResponse.CreatedAt,
+		Done:               chatResponse.Done,
+		DoneReason:         chatResponse.DoneReason,
+		TotalDuration:      chatResponse.TotalDuration,
+		LoadDuration:       chatResponse.LoadDuration,
+		PromptEvalCount:    chatResponse.PromptEvalCount,
+		PromptEvalDuration: chatResponse.PromptEvalDuration,
+		EvalCount:          chatResponse.EvalCount,
+		EvalDuration:       chatResponse.EvalDuration,
+		Usage: &TokenUsage{
+			PromptTokens:     chatResponse.PromptEvalCount,
+			CompletionTokens: chatResponse.EvalCount,
+			TotalTokens:      chatResponse.PromptEvalCount + chatResponse.EvalCount,
+		},
+		Metadata: map[string]interface{}{
+			"message_count":       len(input.Messages),
+			"response_length":     len(content),
+			"response_role":       chatResponse.Message.Role,
+			"ollama_url":          input.OllamaURL,
+			"stream_mode":         *input.Stream,
+			"processing_complete": true,
+			"go_version":          "tinygo",
+			"timestamp":           time.Now().Format(time.RFC3339),
+		},
+	}
+	if streamChunks > 0 {
+		output.Metadata["stream_chunks"] = streamChunks
+	}
+	if input.MaxHistoryMessages > 0 {
+		output.Metadata["trimmed_messages"] = trimmedMessages
+	}
+	if input.Options != nil {
+		output.Metadata["has_custom_options"] = true
+	}
+	if input.KeepAlive != "" {
+		output.Metadata["keep_alive_seconds"] = keepAliveSeconds
+	}
+	addThroughputMetadata(output)
+	output.TotalTokens = output.Usage.TotalTokens
+	sessionUsage.Add(*output.Usage)
+	output.Metadata["session_usage"] = sessionUsage
+
+	return output
+}
+
+// Error output for a failed /api/generate or /api/chat request, with the
+// retries made across all servers tried and the latency and trace context
+// of the last exchange. hint says what to check when the server answers 404.
+func modelRequestFailureOutput(err error, url, model string, retries int, opts *httpRequestOptions, hint string) *OllamaOutput {
+	logError("HTTP request failed: %v", err)
+	metadata := map[string]interface{}{
+		"error_stage": "http_request",
+		"ollama_url":  url,
+		"model":       model,
+		"retry_count": retries,
+	}
+	addLatencyMetadata(metadata, opts)
+	addTraceMetadata(metadata, opts.Trace)
+	if _, ok := err.(*responseDecodeError); ok {
+		metadata["error_stage"] = "response_decoding"
+		metadata["response_compressed"] = opts.Compressed
+		return createErrorOutput(err.Error(), "RESPONSE_DECODE_ERROR", metadata)
+	}
+	return httpRequestErrorOutput(err, metadata, hint)
+}
+
+// Decode an /api/generate or /api/chat response body, aggregating the
+// NDJSON chunks when it is streamed. Returns the response, the chunks
+// decoded and skipped, or the RESPONSE_PARSE_ERROR output to return
+// instead.
+func decodeModelResponse(body string, stream bool, maxBadChunks int) (*ChatAPIResponse, int, int, *OllamaOutput) {
+	if !stream {
+		var response ChatAPIResponse
+		if err := json.Unmarshal([]byte(body), &response); err != nil {
+			logError("Failed to parse Ollama response: %v", err)
+			return nil, 0, 0, createErrorOutput(
+				fmt.Sprintf("Invalid response from Ollama server: %v", err),
+				"RESPONSE_PARSE_ERROR",
+				map[string]interface{}{
+					"error_stage":     "response_parsing",
+					"raw_response":    body,
+					"response_length": len(body),
+				},
+			)
+		}
+		return &response, 0, 0, nil
+	}
+
+	streamed, chunks, skipped, err := parseStreamResponse(body, maxBadChunks)
+	if err != nil {
+		logError("Failed to parse Ollama stream: %v", err)
+		metadata := map[string]interface{}{
+			"error_stage":     "response_parsing",
+			"stream_mode":     true,
+			"stream_chunks":   chunks,
+			"skipped_chunks":  skipped,
+			"response_length": len(body),
+		}
+		if lineErr, ok := err.(*streamLineError); ok {
+			metadata["raw_line"] = lineErr.Line
+			metadata["line_number"] = lineErr.LineNumber
+		}
+		return nil, chunks, skipped, createErrorOutput(
+			fmt.Sprintf("Invalid response from Ollama server: %v", err),
+			"RESPONSE_PARSE_ERROR",
+			metadata,
+		)
+	}
+	return streamed, chunks, skipped, nil
+}
+
+// Validate an OpenAI-style chat input, call /v1/chat/completions and map
+// the reply and usage counts onto an Ollama output
+func runOpenAIChat(input *OpenAIChatInput) *OllamaOutput {
+	var validationErr error
+	switch {
+	case input.Model == "":
+		validationErr = fmt.Errorf("model field is required")
+	case len(input.Messages) == 0:
+		validationErr = fmt.Errorf("messages must contain at least one message")
+	case input.Temperature != nil && (*input.Temperature < 0 || *input.Temperature > 2):
+		validationErr = fmt.Errorf("temperature must be between 0 and 2")
+	case input.MaxTokens != nil && *input.MaxTokens <= 0:
+		validationErr = fmt.Errorf("max_tokens must be positive")
+	default:
+		validationErr = validateOllamaURL(input.OllamaURL)
+	}
+	if validationErr == nil {
+		validationErr = validateChatMessages(input.Messages)
+	}
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return createErrorOutput(validationErr.Error(), "VALIDATION_ERROR", map[string]interface{}{
+			"error_stage": "validation",
+			"model":       input.Model,
+		})
+	}
+
+	input.OllamaURL = strings.TrimRight(input.OllamaURL, "/")
+	requestBody, err := json.Marshal(OpenAIChatRequest{
+		Model:       input.Model,
+		Messages:    input.Messages,
+		Temperature: input.Temperature,
+		MaxTokens:   input.MaxTokens,
+	})
+	if err != nil {
+		logError("Failed to marshal request: %v", err)
+		return createErrorOutput(
+			fmt.Sprintf("Failed to prepare request: %v", err),
+			"REQUEST_MARSHAL_ERROR",
+			map[string]interface{}{
+				"error_stage": "request_preparation",
+				"model":       input.Model,
+			},
+		)
+	}
+
+	url := input.OllamaURL + "/v1/chat/completions"
+	logInfo("Making request to OpenAI-compatible API: %s", url)
+	responseBody, err := makeHttpRequest(url, "POST", string(requestBody), newRequestOptions())
+	if err != nil {
+		logError("HTTP request failed: %v", err)
+		return httpRequestErrorOutput(err, map[string]interface{}{
+			"error_stage": "http_request",
+			"ollama_url":  url,
+			"model":       input.Model,
+		}, "wrong URL or model not installed; check ollama_url and that the server exposes the OpenAI-compatible API")
+	}
+
+	var completion OpenAIChatResponse
+	if err := json.Unmarshal([]byte(responseBody), &completion); err != nil || len(completion.Choices) == 0 {
+		if err == nil {
+			err = fmt.Errorf("response contains no choices")
+		}
+		logError("Failed to parse chat completion: %v", err)
+		return createErrorOutput(
+			fmt.Sprintf("Invalid response from Ollama server: %v", err),
+			"RESPONSE_PARSE_ERROR",
+			map[string]interface{}{
+				"error_stage":     "response_parsing",
+				"raw_response":    responseBody,
+				"response_length": len(responseBody),
+			},
+		)
+	}
+
+	choice := completion.Choices[0]
+	content := choice.Message.Content
+	logInfo("Successfully parsed chat completion (%d characters)", len(content))
+
+	usage := completion.Usage
+	if usage.TotalTokens == 0 {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	output := &OllamaOutput{
+		Success:         true,
+		Response:        content,
+		Model:           completion.Model,
+		Done:            true,
+		DoneReason:      choice.FinishReason,
+		PromptEvalCount: usage.PromptTokens,
+		EvalCount:       usage.CompletionTokens,
+		TotalTokens:     usage.TotalTokens,
+		Usage:           &usage,
+		Metadata: map[string]interface{}{
+			"completion_id":       completion.ID,
+			"finish_reason":       choice.FinishReason,
+			"message_count":       len(input.Messages),
+			"response_length":     len(content),
+			"response_role":       choice.Message.Role,
+			"ollama_url":          input.OllamaURL,
+			"processing_complete": true,
+			"go_version":          "tinygo",
+			"timestamp":           time.Now().Format(time.RFC3339),
+		},
+	}
+	if completion.Created > 0 {
+		output.CreatedAt = time.Unix(completion.Created, 0).UTC().Format(time.RFC3339)
+	}
+	sessionUsage.Add(usage)
+	output.Metadata["session_usage"] = sessionUsage
+
+	return output
+}
+
+// Check that a response is valid JSON and, for a schema format, that it
+// satisfies the schema's type, required, properties, items and enum rules
+func validateResponseFormat(response string, format interface{}) error {
+	var value interface{}
+	if err := json.Unmarshal([]byte(response), &value); err != nil {
+		return fmt.Errorf("response is not valid JSON: %v", err)
+	}
+	if schema, ok := format.(map[string]interface{}); ok {
+		return validateSchemaValue(value, schema, "$")
+	}
+	return nil
+}
+
+// Follow a dot path through a JSON response, reporting false when the
+// response is not JSON or the path leads nowhere
+func extractJSONPath(response, path string) (interface{}, bool) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(response)), &value); err != nil {
+		return nil, false
+	}
+	for _, segment := range strings.Split(path, ".") {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			next, ok := node[segment]
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			value = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// Validate a decoded JSON value against a subset of JSON schema
+func validateSchemaValue(value interface{}, schema map[string]interface{}, path string) error {
+	if expected, ok := schema["type"].(string); ok && !jsonTypeMatches(value, expected) {
+		return fmt.Errorf("%s should be of type %s", path, expected)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s is not one of the allowed values", path)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if key, ok := name.(string); ok {
+					if _, present := v[key]; !present {
+						return fmt.Errorf("%s is missing required property %q", path, key)
+					}
+				}
+			}
+		}
+		if properties, ok := schema["properties"].(map[string]interface{}); ok {
+			for key, propertySchema := range properties {
+				propertyValue, present := v[key]
+				nested, isSchema := propertySchema.(map[string]interface{})
+				if !present || !isSchema {
+					continue
+				}
+				if err := validateSchemaValue(propertyValue, nested, path+"."+key); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validateSchemaValue(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Report whether a decoded JSON value has the given JSON schema type
+func jsonTypeMatches(value interface{}, expected string) bool {
+	switch expected {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return true
+}
+
+// Record what request preparation changed or detected
+func addPreparationMetadata(metadata map[string]interface{}, prepared *preparedGeneration, input *OllamaInput) {
+	metadata["normalized_model"] = input.Model
+	metadata["seed"] = prepared.Seed
+	metadata["seed_generated"] = prepared.SeedGenerated
+	metadata["estimated_prompt_tokens"] = prepared.EstimatedTokens
+	metadata["context_overflow_estimate"] = prepared.EstimatedTokens > prepared.ContextWindow
+	if len(input.TemplateVars) > 0 {
+		metadata["template_substitutions"] = input.templateSubstitutions
+	}
+	if len(prepared.Images) > 0 {
+		metadata["images"] = prepared.Images
+	}
+	if len(input.FewShotExamples) > 0 {
+		metadata["few_shot_injected"] = prepared.FewShotInjected
+		metadata["few_shot_dropped"] = len(input.FewShotExamples) - prepared.FewShotInjected
+	}
+}
+
+const defaultEmptyMaxRetries = 2
+
+// Run the generation and, when RetryOnEmpty is set, retry while the
+// response is empty or whitespace-only. The first non-empty response wins;
+// otherwise the last successful attempt is returned as is.
+func runEmptyRetryGeneration(input *OllamaInput) *OllamaOutput {
+	output := runGeneration(input)
+	if !input.RetryOnEmpty || !output.Success {
+		return output
+	}
+
+	retries := defaultEmptyMaxRetries
+	if input.EmptyMaxRetries != nil {
+		retries = *input.EmptyMaxRetries
+	}
+
+	emptyRetries := 0
+	for strings.TrimSpace(output.Response) == "" && emptyRetries < retries {
+		emptyRetries++
+		logInfo("Empty response, retrying (%d/%d)", emptyRetries, retries)
+		retry := *input
+		if numPredict, ok := input.Options["num_predict"].(float64); ok && numPredict > 0 && input.EmptyNumPredictStep > 0 {
+			retry.Options = make(map[string]interface{}, len(input.Options))
+			for key, value := range input.Options {
+				retry.Options[key] = value
+			}
+			retry.Options["num_predict"] = numPredict + float64(input.EmptyNumPredictStep*emptyRetries)
+		}
+
+		next := runGeneration(&retry)
+		if !next.Success {
+			logError("Empty-response retry failed: %s", next.Error)
+			break
+		}
+		output = next
+	}
+
+	output.Metadata["empty_retries"] = emptyRetries
+	output.Metadata["empty_response"] = strings.TrimSpace(output.Response) == ""
+	return output
+}
+
+const (
+	defaultPatternMaxRetries = 2
+	defaultTemperature       = 0.8
+	maxTemperature           = 2.0
+)
+
+const (
+	forceJSONInstruction = "Respond only with valid JSON."
+	forceJSONReminder    = "Your previous answer was not valid JSON. Reply with a single valid JSON value and no other text."
+)
+
+// Run the generation and, when ForceJSON is set, retry once if the
+// response does not parse as JSON
+func runForceJSONGeneration(input *OllamaInput) *OllamaOutput {
+	output := runPatternGeneration(input)
+	if !input.ForceJSON || !output.Success {
+		return output
+	}
+
+	retried := false
+	if !json.Valid([]byte(strings.TrimSpace(output.Response))) {
+		logInfo("Response is not valid JSON, retrying once")
+		retry := *input
+		retry.Prompt = input.Prompt + "\n\n" + forceJSONReminder
+		retried = true
+		next := runPatternGeneration(&retry)
+		if next.Success {
+			output = next
+		} else {
+			logError("JSON retry failed: %s", next.Error)
+		}
+	}
+
+	output.Metadata["json_retry"] = retried
+	output.Metadata["json_valid"] = json.Valid([]byte(strings.TrimSpace(output.Response)))
+	return output
+}
+
+// Run the generation and, when ExpectedPattern is set, retry until the
+// response matches. The first matching response wins; otherwise the last
+// successful attempt is returned with pattern_match false.
+func runPatternGeneration(input *OllamaInput) *OllamaOutput {
+	output := runEmptyRetryGeneration(input)
+	if input.ExpectedPattern == "" || !output.Success {
+		return output
+	}
+
+	pattern := regexp.MustCompile(input.ExpectedPattern)
+	retries := defaultPatternMaxRetries
+	if input.PatternMaxRetries != nil {
+		retries = *input.PatternMaxRetries
+	}
+
+	attempts := 1
+	matched := pattern.MatchString(output.Response)
+	for !matched && attempts <= retries {
+		logInfo("Response did not match expected pattern, retrying (%d/%d)", attempts, retries)
+		retry := *input
+		retry.Options = make(map[string]interface{}, len(input.Options)+1)
+		for key, value := range input.Options {
+			retry.Options[key] = value
+		}
+		if input.PatternTemperatureStep > 0 {
+			temperature := defaultTemperature
+			if t, ok := input.Options["temperature"].(float64); ok {
+				temperature = t
+			}
+			temperature += input.PatternTemperatureStep * float64(attempts)
+			if temperature > maxTemperature {
+				temperature = maxTemperature
+			}
+			retry.Options["temperature"] = temperature
+		}
+		if input.PatternCorrection {
+			retry.Prompt = fmt.Sprintf(
+				"%s\n\nYour previous answer did not match the required format (regular expression: %s). Answer again in exactly that format.",
+				input.Prompt, input.ExpectedPattern,
+			)
+		}
+
+		next := runEmptyRetryGeneration(&retry)
+		attempts++
+		if !next.Success {
+			logError("Pattern retry failed: %s", next.Error)
+			break
+		}
+		output = next
+		matched = pattern.MatchString(output.Response)
+	}
+
+	output.Metadata["pattern_match"] = matched
+	output.Metadata["pattern_attempts"] = attempts
+	return output
+}
+
+// Replace a failed generation with the configured fallback text, keeping
+// the underlying error in metadata. Validation errors are caller mistakes
+// and cancellations are deliberate, so neither is masked.
+func applyFallback(failed *OllamaOutput, input *OllamaInput) (*OllamaOutput, bool) {
+	if input.FallbackResponse == "" || failed.Metadata["error_stage"] == "validation" || failed.ErrorType == "CANCELLED" {
+		return failed, false
+	}
+	metadata := failed.Metadata
+	metadata["fallback_used"] = true
+	metadata["fallback_error"] = failed.Error
+	metadata["fallback_error_type"] = failed.ErrorType
+	metadata["processing_complete"] = true
+	return &OllamaOutput{
+		Success:  true,
+		Response: input.FallbackResponse,
+		Model:    input.Model,
+		Done:     true,
+		Metadata: metadata,
+	}, true
+}
+
+// Encode the response for hosts that cannot carry arbitrary text
+func applyResponseEncoding(output *OllamaOutput, encoding string) {
+	if encoding == "base64" {
+		output.Response = base64.StdEncoding.EncodeToString([]byte(output.Response))
+		output.Metadata["response_encoding"] = "base64"
+	} else {
+		output.Metadata["response_encoding"] = "utf8"
+	}
+}
+
+// Main entry point function as required by Float
+//
+//export generate_ollama
+func generate_ollama(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting Ollama text generation")
+
+	// Read and parse input JSON
+	var input OllamaInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+	return generateFromInput(&input)
+}
+
+// Variant of generate_ollama for inputs the host would rather not pass in
+// the buffer: it holds the path of a file with the input JSON, which is
+// read into module memory through the host, subject to the same
+// maxInputSize cap as a buffered input
+//
+//export generate_ollama_from_file
+func generate_ollama_from_file(pathPtr, pathLen uint32) uint32 {
+	logInfo("Starting Ollama text generation from input file")
+
+	var input OllamaInput
+	if !readInputFile(pathPtr, pathLen, &input) {
+		return 1
+	}
+	return generateFromInput(&input)
+}
+
+// Run generate_ollama for a parsed input and write its output
+func generateFromInput(input *OllamaInput) uint32 {
+	logInfo("Parsed input for model: %s", input.Model)
+	input.events = newEventLog(input.EventLogPath)
+
+	// A dry run validates and assembles the request but never sends it
+	if input.DryRun {
+		prepared, failed := prepareGeneration(input)
+		output := failed
+		if failed == nil {
+			output = resolvedRequestOutput(input, prepared)
+			output.Metadata["request_body"] = string(prepared.Body)
+			output.Metadata["dry_run"] = true
+		}
+		if writeErr := writeGenerationOutput(input, output); writeErr != nil {
+			logError("Failed to write output file: %v", writeErr)
+			return 1
+		}
+		if !output.Success {
+			return 1
+		}
+		logInfo("Dry run completed without contacting the server")
+		return 0
+	}
+
+	output := runForceJSONGeneration(input)
+	if !output.Success {
+		fallback, used := applyFallback(output, input)
+		if !used {
+			if writeErr := writeGenerationOutput(input, output); writeErr != nil {
+				input.events.record("output_written", "error", writeErr.Error())
+			} else {
+				input.events.record("output_written", "ok", output.ErrorType)
+			}
+			return 1
+		}
+		logError("Generation failed (%s), returning fallback response", output.ErrorType)
+		applyResponseEncoding(fallback, input.ResponseEncoding)
+		if writeErr := writeGenerationOutput(input, fallback); writeErr != nil {
+			input.events.record("output_written", "error", writeErr.Error())
+			logError("Failed to write output file: %v", writeErr)
+			return 1
+		}
+		input.events.record("output_written", "ok", "fallback")
+		return fallbackReturnCode
+	}
+	responseLength := len(output.Response)
+	applyResponseEncoding(output, input.ResponseEncoding)
+
+	// Write output file
+	if writeErr := writeGenerationOutput(input, output); writeErr != nil {
+		input.events.record("output_written", "error", writeErr.Error())
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+	input.events.record("output_written", "ok", "")
+
+	logInfo("Ollama text generation completed successfully")
+	logInfo("Generated %d characters in response", responseLength)
+
+	return 0
+}
+
+// Chat entry point: sends a messages array to /api/chat and returns the
+// assistant reply in the same output shape as generate_ollama
+//
+//export generate_chat
+func generate_chat(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting Ollama chat")
+
+	var input ChatInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	logInfo("Parsed chat input for model: %s (%d messages)", input.Model, len(input.Messages))
+
+	output := runChat(&input)
+	if !output.Success {
+		return writeErrorOutput(output)
+	}
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Ollama chat completed successfully")
+	return 0
+}
+
+// Chat through the OpenAI-compatible /v1/chat/completions endpoint, for
+// deployments that only expose that API
+//
+//export generate_openai_chat
+func generate_openai_chat(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting OpenAI-compatible chat")
+
+	var input OpenAIChatInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	logInfo("Parsed chat input for model: %s (%d messages)", input.Model, len(input.Messages))
+
+	output := runOpenAIChat(&input)
+	if !output.Success {
+		return writeErrorOutput(output)
+	}
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("OpenAI-compatible chat completed successfully")
+	return 0
+}
+
+// Run several prompts against one model with sequential /api/generate
+// calls, keeping the model loaded in between. A failed prompt is recorded
+// in its result and the batch carries on.
+//
+//export generate_batch
+func generate_batch(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting batch generation")
+
+	var input BatchInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	var validationErr error
+	switch {
+	case input.Model == "":
+		validationErr = fmt.Errorf("model field is required")
+	case len(input.Prompts) == 0:
+		validationErr = fmt.Errorf("prompts must contain at least one prompt")
+	case len(input.Prompts) > maxBatchPrompts:
+		validationErr = fmt.Errorf("prompts exceeds maximum of %d entries", maxBatchPrompts)
+	default:
+		validationErr = validateOllamaURL(input.OllamaURL)
+	}
+	if validationErr == nil {
+		validationErr = validateOptions(input.Options)
+	}
+	if validationErr == nil && input.KeepAlive != "" {
+		input.KeepAlive, _, validationErr = parseKeepAlive(input.KeepAlive)
+	}
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return writeError("VALIDATION_ERROR", validationErr.Error(), map[string]interface{}{
+			"error_stage": "validation",
+			"model":       input.Model,
+		})
+	}
+	baseURL := strings.TrimRight(input.OllamaURL, "/")
+	promptInput := func(prompt string) *OllamaInput {
+		return &OllamaInput{
+			Model:     input.Model,
+			Prompt:    prompt,
+			OllamaURL: baseURL,
+			System:    input.System,
+			Format:    input.Format,
+			Options:   input.Options,
+			KeepAlive: input.KeepAlive,
+		}
+	}
+
+	// Validate every prompt before making any request, so a batch does not
+	// fail halfway through on an entry that could have been caught here
+	invalid := make([]InvalidBatchPrompt, 0)
+	invalidErrors := make(map[int]string)
+	for i, prompt := range input.Prompts {
+		if err := validateInput(promptInput(prompt)); err != nil {
+			invalid = append(invalid, InvalidBatchPrompt{Index: i, Error: err.Error()})
+			invalidErrors[i] = err.Error()
+		}
+	}
+	validCount := len(input.Prompts) - len(invalid)
+	if len(invalid) > 0 && (!input.SkipInvalid || validCount == 0) {
+		logError("Batch validation failed: %d of %d prompts are invalid", len(invalid), len(input.Prompts))
+		indices := make([]string, len(invalid))
+		for i, entry := range invalid {
+			indices[i] = strconv.Itoa(entry.Index)
+		}
+		return writeError(
+			"VALIDATION_ERROR",
+			fmt.Sprintf("batch prompts %s are invalid", strings.Join(indices, ", ")),
+			map[string]interface{}{
+				"error_stage":     "batch_validation",
+				"model":           input.Model,
+				"valid_count":     validCount,
+				"invalid_count":   len(invalid),
+				"invalid_prompts": invalid,
+			},
+		)
+	}
+
+	results := make([]BatchResult, len(input.Prompts))
+	failed := 0
+	var totalDuration int64
+	for i, prompt := range input.Prompts {
+		results[i] = BatchResult{Index: i}
+		if message, ok := invalidErrors[i]; ok {
+			logInfo("Skipping invalid batch prompt %d: %s", i, message)
+			results[i].Error = message
+			results[i].ErrorType = "VALIDATION_ERROR"
+			failed++
+			continue
+		}
+		logInfo("Generating batch prompt %d of %d", i+1, len(input.Prompts))
+		generation := runGeneration(promptInput(prompt))
+		if !generation.Success {
+			logError("Batch prompt %d failed: %s", i, generation.Error)
+			results[i].Error = generation.Error
+			results[i].ErrorType = generation.ErrorType
+			failed++
+			continue
+		}
+		results[i].Response = generation.Response
+		results[i].PromptEvalCount = generation.PromptEvalCount
+		results[i].EvalCount = generation.EvalCount
+		results[i].TotalDuration = generation.TotalDuration
+		totalDuration += generation.TotalDuration
+	}
+
+	output := &BatchOutput{
+		Success:   failed < len(results),
+		Model:     input.Model,
+		Responses: results,
+		Metadata: map[string]interface{}{
+			"prompt_count":        len(results),
+			"succeeded":           len(results) - failed,
+			"failed":              failed,
+			"valid_count":         validCount,
+			"invalid_count":       len(invalid),
+			"invalid_prompts":     invalid,
+			"total_duration":      totalDuration,
+			"session_usage":       sessionUsage,
+			"ollama_url":          baseURL,
+			"processing_complete": true,
+			"timestamp":           time.Now().Format(time.RFC3339),
+		},
+	}
+	if !output.Success {
+		output.Error = fmt.Sprintf("all %d prompts failed", len(results))
+		output.ErrorType = "BATCH_FAILED"
+		return writeErrorOutput(output)
+	}
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Batch completed: %d of %d prompts succeeded", len(results)-failed, len(results))
+	return 0
+}
+
+// Fetch a model's details via /api/show
+func fetchModelInfo(baseURL, model string, opts *httpRequestOptions) (*ShowModelAPIResponse, error) {
+	requestBody, err := json.Marshal(map[string]string{"name": model})
+	if err != nil {
+		return nil, err
+	}
+	responseBody, err := makeHttpRequest(baseURL+"/api/show", "POST", string(requestBody), opts)
+	if err != nil {
+		return nil, err
+	}
+	var info ShowModelAPIResponse
+	if err := json.Unmarshal([]byte(responseBody), &info); err != nil {
+		return nil, fmt.Errorf("invalid /api/show response: %v", err)
+	}
+	return &info, nil
+}
+
+// Fetch the models currently loaded into memory via /api/ps
+func fetchRunningModels(baseURL string, opts *httpRequestOptions) ([]RunningModel, error) {
+	responseBody, err := makeHttpRequest(baseURL+"/api/ps", "GET", "", opts)
+	if err != nil {
+		return nil, err
+	}
+	var ps RunningModelsAPIResponse
+	if err := json.Unmarshal([]byte(responseBody), &ps); err != nil {
+		return nil, fmt.Errorf("invalid /api/ps response: %v", err)
+	}
+	return ps.Models, nil
+}
+
+// /api/show results keyed by model digest, kept for the lifetime of the
+// module instance since a digest's details never change
+var modelInfoCache = make(map[string]*ShowModelAPIResponse)
+
+// Fetch model details, reusing a cached result for the same digest
+func fetchModelInfoCached(baseURL string, model ModelInfo, opts *httpRequestOptions) (*ShowModelAPIResponse, bool, error) {
+	if model.Digest != "" {
+		if info, ok := modelInfoCache[model.Digest]; ok {
+			return info, true, nil
+		}
+	}
+	info, err := fetchModelInfo(baseURL, model.Name, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	if model.Digest != "" {
+		modelInfoCache[model.Digest] = info
+	}
+	return info, false, nil
+}
+
+// Send an empty generate request, which only loads (or with keep_alive 0,
+// unloads) the model
+func setModelKeepAlive(baseURL, model string, keepAlive interface{}, opts *httpRequestOptions) (*OllamaAPIResponse, error) {
+	requestBody, err := json.Marshal(map[string]interface{}{"model": model, "keep_alive": keepAlive})
+	if err != nil {
+		return nil, err
+	}
+	responseBody, err := makeHttpRequest(baseURL+"/api/generate", "POST", string(requestBody), opts)
+	if err != nil {
+		return nil, err
+	}
+	var response OllamaAPIResponse
+	if err := json.Unmarshal([]byte(responseBody), &response); err != nil {
+		return nil, fmt.Errorf("invalid /api/generate response: %v", err)
+	}
+	return &response, nil
+}
+
+// Unload a model by sending an empty generate request with keep_alive 0
+func unloadModel(baseURL, model string, opts *httpRequestOptions) error {
+	_, err := setModelKeepAlive(baseURL, model, 0, opts)
+	return err
+}
+
+// Fetch the installed models via /api/tags
+func fetchInstalledModels(baseURL string, opts *httpRequestOptions) ([]ModelInfo, error) {
+	responseBody, err := makeHttpRequest(baseURL+"/api/tags", "GET", "", opts)
+	if err != nil {
+		return nil, err
+	}
+	var tags TagsAPIResponse
+	if err := json.Unmarshal([]byte(responseBody), &tags); err != nil {
+		return nil, fmt.Errorf("invalid /api/tags response: %v", err)
+	}
+	return tags.Models, nil
+}
+
+// Parse a parameter size such as "7B", "7.2B" or "270M" into a parameter count
+func parseParameterCount(size string) (float64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	if size == "" {
+		return 0, fmt.Errorf("parameter size is empty")
+	}
+	multiplier := 1.0
+	switch size[len(size)-1] {
+	case 'K':
+		multiplier = 1e3
+	case 'M':
+		multiplier = 1e6
+	case 'B':
+		multiplier = 1e9
+	case 'T':
+		multiplier = 1e12
+	}
+	if multiplier != 1.0 {
+		size = size[:len(size)-1]
+	}
+	value, err := strconv.ParseFloat(size, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("unrecognized parameter size %q", size)
+	}
+	return value * multiplier, nil
+}
+
+// Approximate bits per weight for common GGUF quantization levels
+var quantizationBits = map[string]float64{
+	"F32":    32,
+	"F16":    16,
+	"BF16":   16,
+	"Q8_0":   8.5,
+	"Q6_K":   6.56,
+	"Q5_1":   6,
+	"Q5_K_M": 5.69,
+	"Q5_K_S": 5.54,
+	"Q5_0":   5.5,
+	"Q4_1":   5,
+	"Q4_K_M": 4.85,
+	"Q4_K_S": 4.58,
+	"Q4_0":   4.5,
+	"Q3_K_L": 4.27,
+	"Q3_K_M": 3.91,
+	"Q3_K_S": 3.5,
+	"Q2_K":   3.35,
+}
+
+const (
+	// Extra memory for KV cache and compute buffers, relative to the weights
+	vramOverheadFraction = 0.2
+	// Fixed runtime allocation independent of model size
+	vramFixedOverheadBytes = 256 << 20
+)
+
+// Estimate VRAM requirements for a model from its details and predict
+// whether it fits next to the models already loaded
+//
+//export estimate_vram
+func estimate_vram(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting VRAM estimate")
+
+	var input VRAMEstimateInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	validationErr := validateOllamaURL(input.OllamaURL)
+	if validationErr == nil && input.Model == "" {
+		validationErr = fmt.Errorf("model field is required")
+	}
+	if validationErr == nil && input.GPUVRAMBytes < 0 {
+		validationErr = fmt.Errorf("gpu_vram_bytes cannot be negative")
+	}
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return writeError("VALIDATION_ERROR", validationErr.Error(), map[string]interface{}{
+			"error_stage": "validation",
+			"model":       input.Model,
+		})
+	}
+	input.OllamaURL = strings.TrimRight(input.OllamaURL, "/")
+
+	info, err := fetchModelInfo(input.OllamaURL, input.Model, newRequestOptions())
+	if err != nil {
+		logError("Failed to fetch model info: %v", err)
+		return writeFetchError(err, "Failed to fetch model info", map[string]interface{}{
+			"error_stage": "model_info",
+			"ollama_url":  input.OllamaURL,
+			"model":       input.Model,
+		})
+	}
+
+	params, err := parseParameterCount(info.Details.ParameterSize)
+	if err != nil {
+		logError("Cannot estimate VRAM: %v", err)
+		return writeError(
+			"RESPONSE_PARSE_ERROR",
+			fmt.Sprintf("Cannot estimate VRAM: %v", err),
+			map[string]interface{}{
+				"error_stage": "estimation",
+				"model":       input.Model,
+			},
+		)
+	}
+
+	metadata := map[string]interface{}{
+		"ollama_url":          input.OllamaURL,
+		"parameter_count":     params,
+		"overhead_fraction":   vramOverheadFraction,
+		"fixed_overhead":      vramFixedOverheadBytes,
+		"estimation_formula":  "parameters * bits_per_weight / 8 * (1 + overhead_fraction) + fixed_overhead",
+		"estimation_assumes":  "default context length; KV cache and compute buffers folded into overhead_fraction",
+		"processing_complete": true,
+		"timestamp":           time.Now().Format(time.RFC3339),
+	}
+
+	bits, known := quantizationBits[strings.ToUpper(info.Details.QuantizationLevel)]
+	if !known {
+		// Unknown quantization: assume unquantized half precision weights
+		bits = 16
+		metadata["quantization_assumed"] = "F16"
+	}
+	metadata["bits_per_weight"] = bits
+
+	weightBytes := params * bits / 8
+	estimate := int64(weightBytes*(1+vramOverheadFraction)) + vramFixedOverheadBytes
+
+	output := &VRAMEstimateOutput{
+		Success:            true,
+		Model:              input.Model,
+		ParameterSize:      info.Details.ParameterSize,
+		QuantizationLevel:  info.Details.QuantizationLevel,
+		EstimatedVRAMBytes: estimate,
+		Metadata:           metadata,
+	}
+
+	// Compare against what is currently resident
+	running, err := fetchRunningModels(input.OllamaURL, newRequestOptions())
+	if err != nil {
+		logError("Failed to list running models: %v", err)
+		metadata["running_models_error"] = err.Error()
+	}
+	var loadedVRAM int64
+	alreadyLoaded := false
+	for _, m := range running {
+		if m.Name == input.Model || m.Model == input.Model {
+			alreadyLoaded = true
+			continue
+		}
+		loadedVRAM += m.SizeVRAM
+	}
+	metadata["loaded_models"] = len(running)
+	metadata["loaded_vram_bytes"] = loadedVRAM
+
+	switch {
+	case alreadyLoaded:
+		output.WillLikelyFit = true
+		metadata["fit_basis"] = "already_loaded"
+	case input.GPUVRAMBytes > 0:
+		free := input.GPUVRAMBytes - loadedVRAM
+		output.WillLikelyFit = estimate <= free
+		metadata["fit_basis"] = "gpu_vram_bytes minus loaded models"
+		metadata["free_vram_bytes"] = free
+	case loadedVRAM > 0:
+		// Without a known capacity, the best evidence is how much VRAM the
+		// GPU is holding right now; Ollama can evict those models to make room
+		output.WillLikelyFit = estimate <= loadedVRAM
+		metadata["fit_basis"] = "currently loaded vram (capacity unknown)"
+	default:
+		metadata["fit_basis"] = "unknown capacity, provide gpu_vram_bytes"
+	}
+
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Estimated %d bytes of VRAM for %s (fits: %v)", estimate, input.Model, output.WillLikelyFit)
+	return 0
+}
+
+// Check whether a model's tag details satisfy the filter. Parameter bounds
+// have already been parsed; zero means unbounded.
+func matchesModelFilter(model ModelInfo, filter *ModelFilterInput, minParams, maxParams float64) bool {
+	details := model.Details
+	if filter.Family != "" {
+		family := strings.ToLower(filter.Family)
+		found := strings.Contains(strings.ToLower(details.Family), family)
+		for _, f := range details.Families {
+			found = found || strings.Contains(strings.ToLower(f), family)
+		}
+		if !found {
+			return false
+		}
+	}
+	if filter.QuantizationLevel != "" && !strings.EqualFold(details.QuantizationLevel, filter.QuantizationLevel) {
+		return false
+	}
+	if minParams > 0 || maxParams > 0 {
+		params, err := parseParameterCount(details.ParameterSize)
+		if err != nil {
+			return false
+		}
+		if (minParams > 0 && params < minParams) || (maxParams > 0 && params > maxParams) {
+			return false
+		}
+	}
+	return true
+}
+
+// Download a model via /api/pull. The streamed status lines are reduced
+// to the final status and the last reported byte counts, and each layer's
+// first and last counts tell what was already present from an earlier,
+// interrupted pull.
+//
+//export pull_model
+func pull_model(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting model pull")
+
+	var input PullModelInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	resumeAttempts := defaultPullResumeAttempts
+	if input.ResumeAttempts != nil {
+		resumeAttempts = *input.ResumeAttempts
+	}
+	validationErr := validateOllamaURL(input.OllamaURL)
+	switch {
+	case validationErr != nil:
+	case strings.TrimSpace(input.Name) == "":
+		validationErr = fmt.Errorf("name field is required")
+	case resumeAttempts < 0 || resumeAttempts > maxPullResumeAttempts:
+		validationErr = fmt.Errorf("resume_attempts must be between 0 and %d", maxPullResumeAttempts)
+	}
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return writeError("VALIDATION_ERROR", validationErr.Error(), map[string]interface{}{
+			"error_stage": "validation",
+			"model":       input.Name,
+		})
+	}
+	baseURL := strings.TrimRight(input.OllamaURL, "/")
+
+	requestBody, err := json.Marshal(PullAPIRequest{Name: input.Name, Stream: input.Stream})
+	if err != nil {
+		logError("Failed to marshal request: %v", err)
+		return writeError(
+			"REQUEST_MARSHAL_ERROR",
+			fmt.Sprintf("Failed to prepare request: %v", err),
+			map[string]interface{}{
+				"error_stage": "request_preparation",
+				"model":       input.Name,
+			},
+		)
+	}
+
+	// A pull cut off by a dropped connection or a download error line is
+	// started again; the server keeps the partial layers and resumes them
+	logInfo("Pulling model %s", input.Name)
+	layers := make(map[string]*layerProgress)
+	var last PullStatusLine
+	statusLines, resumes := 0, 0
+	for {
+		var responseBody string
+		responseBody, err = makeHttpRequest(baseURL+"/api/pull", "POST", string(requestBody), newRequestOptions())
+		if err != nil && isConnectionFailure(err) && resumes < resumeAttempts {
+			resumes++
+			logInfo("Pull of %s was interrupted (%v), resuming (%d/%d)", input.Name, err, resumes, resumeAttempts)
+			continue
+		}
+		if err != nil {
+			logError("Pull request failed: %v", err)
+			metadata := map[string]interface{}{
+				"error_stage":     "http_request",
+				"ollama_url":      baseURL + "/api/pull",
+				"model":           input.Name,
+				"resume_attempts": resumes,
+			}
+			return writeErrorOutput(httpRequestErrorOutput(err, metadata, "check ollama_url"))
+		}
+
+		var lines int
+		last, lines, err = readStatusStream(responseBody, layers)
+		statusLines += lines
+		if err == nil && last.Status != "success" {
+			err = fmt.Errorf("pull ended with status %q", last.Status)
+		}
+		if _, parseErr := err.(*streamLineError); err == nil || parseErr || resumes >= resumeAttempts {
+			break
+		}
+		resumes++
+		logInfo("Pull of %s was interrupted (%v), resuming (%d/%d)", input.Name, err, resumes, resumeAttempts)
+	}
+	present, downloaded, partial := pullTransfer(layers)
+
+	if err != nil {
+		logError("Pull failed: %v", err)
+		errorType := "PULL_ERROR"
+		metadata := map[string]interface{}{
+			"error_stage":           "pull",
+			"model":                 input.Name,
+			"last_status":           last.Status,
+			"bytes_completed":       last.Completed,
+			"bytes_total":           last.Total,
+			"resume_attempts":       resumes,
+			"bytes_already_present": present,
+			"bytes_downloaded":      downloaded,
+		}
+		if lineErr, ok := err.(*streamLineError); ok {
+			errorType = "RESPONSE_PARSE_ERROR"
+			metadata["error_stage"] = "response_parsing"
+			metadata["raw_line"] = lineErr.Line
+			metadata["line_number"] = lineErr.LineNumber
+		}
+		return writeError(errorType, fmt.Sprintf("Failed to pull %s: %v", input.Name, err), metadata)
+	}
+
+	output := &PullModelOutput{
+		Success:        true,
+		Status:         last.Status,
+		BytesCompleted: last.Completed,
+		BytesTotal:     last.Total,
+		Metadata: map[string]interface{}{
+			"model":                 input.Name,
+			"status_lines":          statusLines,
+			"last_digest":           last.Digest,
+			"resumed":               partial || resumes > 0,
+			"resume_attempts":       resumes,
+			"bytes_already_present": present,
+			"bytes_downloaded":      downloaded,
+			"ollama_url":            baseURL,
+			"processing_complete":   true,
+			"timestamp":             time.Now().Format(time.RFC3339),
+		},
+	}
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Pulled %s (%d bytes, %d already present)", input.Name, last.Total, present)
+	return 0
+}
+
+// Upload a model to a registry via /api/push. The streamed status lines
+// are reduced to the final status and the last reported byte counts.
+//
+//export push_model
+func push_model(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting model push")
+
+	var input PushModelInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	validationErr := validateOllamaURL(input.OllamaURL)
+	switch {
+	case validationErr != nil:
+	case strings.TrimSpace(input.Name) == "":
+		validationErr = fmt.Errorf("name field is required")
+	case !hasModelNamespace(input.Name):
+		validationErr = fmt.Errorf("name must include a namespace, e.g. \"namespace/model:tag\"")
+	}
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return writeError("VALIDATION_ERROR", validationErr.Error(), map[string]interface{}{
+			"error_stage": "validation",
+			"model":       input.Name,
+		})
+	}
+	baseURL := strings.TrimRight(input.OllamaURL, "/")
+
+	requestBody, err := json.Marshal(PushAPIRequest{Name: input.Name, Insecure: input.Insecure})
+	if err != nil {
+		logError("Failed to marshal request: %v", err)
+		return writeError(
+			"REQUEST_MARSHAL_ERROR",
+			fmt.Sprintf("Failed to prepare request: %v", err),
+			map[string]interface{}{
+				"error_stage": "request_preparation",
+				"model":       input.Name,
+			},
+		)
+	}
+
+	logInfo("Pushing model %s", input.Name)
+	responseBody, err := makeHttpRequest(baseURL+"/api/push", "POST", string(requestBody), newRequestOptions())
+	if err != nil {
+		logError("Push request failed: %v", err)
+		metadata := map[string]interface{}{
+			"error_stage": "http_request",
+			"ollama_url":  baseURL + "/api/push",
+			"model":       input.Name,
+		}
+		if statusErr, ok := err.(*httpStatusError); ok && statusErr.Status == 401 {
+			metadata["status_code"] = statusErr.Status
+			return writeError(
+				"AUTH_ERROR",
+				fmt.Sprintf("Registry rejected the push of %s: %v (run `ollama login` on the server)", input.Name, err),
+				metadata,
+			)
+		}
+		return writeErrorOutput(httpRequestErrorOutput(err, metadata, "check ollama_url"))
+	}
+
+	last, statusLines, err := readStatusStream(responseBody, nil)
+	if err == nil && last.Status != "success" {
+		err = fmt.Errorf("push ended with status %q", last.Status)
+	}
+	if err != nil {
+		logError("Push failed: %v", err)
+		errorType := "PUSH_ERROR"
+		metadata := map[string]interface{}{
+			"error_stage":     "push",
+			"model":           input.Name,
+			"last_status":     last.Status,
+			"bytes_completed": last.Completed,
+			"bytes_total":     last.Total,
+		}
+		if lineErr, ok := err.(*streamLineError); ok {
+			errorType = "RESPONSE_PARSE_ERROR"
+			metadata["error_stage"] = "response_parsing"
+			metadata["raw_line"] = lineErr.Line
+			metadata["line_number"] = lineErr.LineNumber
+		} else if strings.Contains(strings.ToLower(err.Error()), "unauthorized") {
+			// The registry's refusal arrives as an error status line
+			errorType = "AUTH_ERROR"
+		}
+		return writeError(errorType, fmt.Sprintf("Failed to push %s: %v", input.Name, err), metadata)
+	}
+
+	output := &PullModelOutput{
+		Success:        true,
+		Status:         last.Status,
+		BytesCompleted: last.Completed,
+		BytesTotal:     last.Total,
+		Metadata: map[string]interface{}{
+			"model":               input.Name,
+			"status_lines":        statusLines,
+			"last_digest":         last.Digest,
+			"ollama_url":          baseURL,
+			"processing_complete": true,
+			"timestamp":           time.Now().Format(time.RFC3339),
+		},
+	}
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Pushed %s (%d bytes)", input.Name, last.Total)
+	return 0
+}
+
+// Report whether a model name has a namespace before the model, as
+// registries require ("namespace/model" or "host/namespace/model")
+func hasModelNamespace(name string) bool {
+	parts := strings.Split(name, "/")
+	if len(parts) < 2 {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Bytes a pull reported for one layer: the completed count of its first
+// status line, which a resumed download starts from, and of its last
+type layerProgress struct {
+	Total     int64
+	Initial   int64
+	Completed int64
+}
+
+// Sum the bytes the layers already had when the pull started and those
+// it downloaded, and report whether any layer continued a partial download
+func pullTransfer(layers map[string]*layerProgress) (int64, int64, bool) {
+	var present, downloaded int64
+	resumed := false
+	for _, layer := range layers {
+		present += layer.Initial
+		if layer.Completed > layer.Initial {
+			downloaded += layer.Completed - layer.Initial
+		}
+		if layer.Initial > 0 && layer.Initial < layer.Total {
+			resumed = true
+		}
+	}
+	return present, downloaded, resumed
+}
+
+// Aggregate the status lines of /api/pull, /api/push or /api/create into
+// the last status and byte counts. A line carrying an error ends the
+// stream with it. When layers is not nil, the progress of each layer
+// digest is recorded in it, keeping the first count seen across calls.
+func readStatusStream(body string, layers map[string]*layerProgress) (PullStatusLine, int, error) {
+	var last PullStatusLine
+	statusLines := 0
+	var splitter lineSplitter
+	handle := func(line string, number int) error {
+		var status PullStatusLine
+		if err := json.Unmarshal([]byte(line), &status); err != nil {
+			return &streamLineError{Line: line, LineNumber: number, Err: err}
+		}
+		statusLines++
+		if status.Error != "" {
+			return fmt.Errorf("%s", status.Error)
+		}
+		if status.Status != "" {
+			last.Status = status.Status
+		}
+		if status.Total > 0 {
+			last.Digest, last.Total, last.Completed = status.Digest, status.Total, status.Completed
+			if layers != nil && status.Digest != "" {
+				layer, ok := layers[status.Digest]
+				if !ok {
+					layer = &layerProgress{Total: status.Total, Initial: status.Completed}
+					layers[status.Digest] = layer
+				}
+				layer.Completed = status.Completed
+			}
+		}
+		return nil
+	}
+	err := splitter.write(body, handle)
+	if err == nil {
+		err = splitter.flush(handle)
+	}
+	return last, statusLines, err
+}
+
+// Write the error output for a failed model management request; a 404
+// means the model is not installed, and other statuses are reported as by
+// httpRequestErrorOutput
+func writeModelRequestError(err error, url, model string) uint32 {
+	metadata := map[string]interface{}{
+		"error_stage": "http_request",
+		"ollama_url":  url,
+		"model":       model,
+	}
+	if statusErr, ok := err.(*httpStatusError); ok && statusErr.Status == 404 {
+		return writeError("MODEL_NOT_FOUND", fmt.Sprintf("Model %s is not installed", model), metadata)
+	}
+	return writeErrorOutput(httpRequestErrorOutput(err, metadata, ""))
+}
+
+// Remove an installed model via DELETE /api/delete to free disk space
+//
+//export delete_model
+func delete_model(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting model deletion")
+
+	var input DeleteModelInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	validationErr := validateOllamaURL(input.OllamaURL)
+	if validationErr == nil && strings.TrimSpace(input.Name) == "" {
+		validationErr = fmt.Errorf("name field is required")
+	}
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return writeError("VALIDATION_ERROR", validationErr.Error(), map[string]interface{}{
+			"error_stage": "validation",
+			"model":       input.Name,
+		})
+	}
+	baseURL := strings.TrimRight(input.OllamaURL, "/")
+
+	requestBody, err := json.Marshal(map[string]string{"name": input.Name})
+	if err != nil {
+		logError("Failed to marshal request: %v", err)
+		return writeError(
+			"REQUEST_MARSHAL_ERROR",
+			fmt.Sprintf("Failed to prepare request: %v", err),
+			map[string]interface{}{
+				"error_stage": "request_preparation",
+				"model":       input.Name,
+			},
+		)
+	}
+
+	logInfo("Deleting model %s", input.Name)
+	opts := newRequestOptions()
+	opts.AllowEmptyBody = true
+	if _, err := makeHttpRequest(baseURL+"/api/delete", "DELETE", string(requestBody), opts); err != nil {
+		logError("Delete request failed: %v", err)
+		return writeModelRequestError(err, baseURL+"/api/delete", input.Name)
+	}
+
+	output := &DeleteModelOutput{
+		Success: true,
+		Model:   input.Name,
+		Metadata: map[string]interface{}{
+			"ollama_url":          baseURL,
+			"processing_complete": true,
+			"timestamp":           time.Now().Format(time.RFC3339),
+		},
+	}
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Deleted model %s", input.Name)
+	return 0
+}
+
+// Duplicate a model under a new name via /api/copy
+//
+//export copy_model
+func copy_model(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting model copy")
+
+	var input CopyModelInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	validationErr := validateOllamaURL(input.OllamaURL)
+	switch {
+	case validationErr != nil:
+	case strings.TrimSpace(input.Source) == "":
+		validationErr = fmt.Errorf("source field is required")
+	case strings.TrimSpace(input.Destination) == "":
+		validationErr = fmt.Errorf("destination field is required")
+	}
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return writeError("VALIDATION_ERROR", validationErr.Error(), map[string]interface{}{
+			"error_stage": "validation",
+			"model":       input.Source,
+		})
+	}
+	baseURL := strings.TrimRight(input.OllamaURL, "/")
+
+	requestBody, err := json.Marshal(map[string]string{
+		"source":      input.Source,
+		"destination": input.Destination,
+	})
+	if err != nil {
+		logError("Failed to marshal request: %v", err)
+		return writeError(
+			"REQUEST_MARSHAL_ERROR",
+			fmt.Sprintf("Failed to prepare request: %v", err),
+			map[string]interface{}{
+				"error_stage": "request_preparation",
+				"model":       input.Source,
+			},
+		)
+	}
+
+	logInfo("Copying model %s to %s", input.Source, input.Destination)
+	opts := newRequestOptions()
+	opts.AllowEmptyBody = true
+	if _, err := makeHttpRequest(baseURL+"/api/copy", "POST", string(requestBody), opts); err != nil {
+		logError("Copy request failed: %v", err)
+		return writeModelRequestError(err, baseURL+"/api/copy", input.Source)
+	}
+
+	output := &CopyModelOutput{
+		Success: true,
+		Metadata: map[string]interface{}{
+			"source":              input.Source,
+			"destination":         input.Destination,
+			"ollama_url":          baseURL,
+			"processing_complete": true,
+			"timestamp":           time.Now().Format(time.RFC3339),
+		},
+	}
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Copied model %s to %s", input.Source, input.Destination)
+	return 0
+}
+
+// Return a model's Modelfile, parameters, template, license and details
+// from /api/show, e.g. for display in a UI
+//
+//export show_model
+func show_model(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting model info lookup")
+
+	var input ShowModelInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	validationErr := validateOllamaURL(input.OllamaURL)
+	if validationErr == nil && strings.TrimSpace(input.Model) == "" {
+		validationErr = fmt.Errorf("model field is required")
+	}
+	normalizedModel := input.Model
+	if validationErr == nil {
+		normalizedModel, validationErr = normalizeModelName(input.Model)
+	}
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return writeError("VALIDATION_ERROR", validationErr.Error(), map[string]interface{}{
+			"error_stage": "validation",
+			"model":       input.Model,
+		})
+	}
+	input.Model = normalizedModel
+	baseURL := strings.TrimRight(input.OllamaURL, "/")
+
+	info, err := fetchModelInfo(baseURL, input.Model, newRequestOptions())
+	if err != nil {
+		logError("Failed to fetch model info: %v", err)
+		switch err.(type) {
+		case *httpStatusError:
+			return writeModelRequestError(err, baseURL+"/api/show", input.Model)
+		}
+		return writeError(
+			"RESPONSE_PARSE_ERROR",
+			fmt.Sprintf("Invalid response from Ollama server: %v", err),
+			map[string]interface{}{
+				"error_stage": "response_parsing",
+				"ollama_url":  baseURL + "/api/show",
+				"model":       input.Model,
+			},
+		)
+	}
+
+	output := &ShowModelOutput{
+		Success:      true,
+		Model:        input.Model,
+		Modelfile:    info.Modelfile,
+		Parameters:   info.Parameters,
+		Template:     info.Template,
+		License:      info.License,
+		Details:      info.Details,
+		Capabilities: info.Capabilities,
+		Metadata: map[string]interface{}{
+			"ollama_url":          baseURL,
+			"processing_complete": true,
+			"timestamp":           time.Now().Format(time.RFC3339),
+		},
+	}
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Fetched model info for %s", input.Model)
+	return 0
+}
+
+// Build a model from a Modelfile via /api/create
+//
+//export create_model
+func create_model(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting model creation")
+
+	var input CreateModelInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	validationErr := validateOllamaURL(input.OllamaURL)
+	switch {
+	case validationErr != nil:
+	case strings.TrimSpace(input.Name) == "":
+		validationErr = fmt.Errorf("name field is required")
+	case strings.TrimSpace(input.Modelfile) == "":
+		validationErr = fmt.Errorf("modelfile field is required")
+	}
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return writeError("VALIDATION_ERROR", validationErr.Error(), map[string]interface{}{
+			"error_stage": "validation",
+			"model":       input.Name,
+		})
+	}
+	baseURL := strings.TrimRight(input.OllamaURL, "/")
+
+	requestBody, err := json.Marshal(CreateAPIRequest{
+		Name:      input.Name,
+		Modelfile: input.Modelfile,
+		Stream:    true,
+	})
+	if err != nil {
+		logError("Failed to marshal request: %v", err)
+		return writeError(
+			"REQUEST_MARSHAL_ERROR",
+			fmt.Sprintf("Failed to prepare request: %v", err),
+			map[string]interface{}{
+				"error_stage": "request_preparation",
+				"model":       input.Name,
+			},
+		)
+	}
+
+	logInfo("Creating model %s", input.Name)
+	responseBody, err := makeHttpRequest(baseURL+"/api/create", "POST", string(requestBody), newRequestOptions())
+	if err != nil {
+		logError("Create request failed: %v", err)
+		metadata := map[string]interface{}{
+			"error_stage": "http_request",
+			"ollama_url":  baseURL + "/api/create",
+			"model":       input.Name,
+		}
+		// The server rejects a bad Modelfile, such as an unknown FROM
+		// model, with a 4xx status
+		if statusErr, ok := err.(*httpStatusError); ok && statusErr.Status >= 400 && statusErr.Status < 500 {
+			metadata["error_stage"] = "create"
+			metadata["status_code"] = statusErr.Status
+			return writeError("CREATE_ERROR", fmt.Sprintf("Failed to create %s: %v", input.Name, err), metadata)
+		}
+		return writeErrorOutput(httpRequestErrorOutput(err, metadata, ""))
+	}
+
+	last, statusLines, err := readStatusStream(responseBody, nil)
+	if err == nil && last.Status != "success" {
+		err = fmt.Errorf("create ended with status %q", last.Status)
+	}
+	if err != nil {
+		logError("Create failed: %v", err)
+		errorType := "CREATE_ERROR"
+		metadata := map[string]interface{}{
+			"error_stage":  "create",
+			"model":        input.Name,
+			"last_status":  last.Status,
+			"status_lines": statusLines,
+		}
+		if lineErr, ok := err.(*streamLineError); ok {
+			errorType = "RESPONSE_PARSE_ERROR"
+			metadata["error_stage"] = "response_parsing"
+			metadata["raw_line"] = lineErr.Line
+			metadata["line_number"] = lineErr.LineNumber
+		}
+		return writeError(errorType, fmt.Sprintf("Failed to create %s: %v", input.Name, err), metadata)
+	}
+
+	output := &CreateModelOutput{
+		Success: true,
+		Status:  last.Status,
+		Metadata: map[string]interface{}{
+			"model":               input.Name,
+			"status_lines":        statusLines,
+			"ollama_url":          baseURL,
+			"processing_complete": true,
+			"timestamp":           time.Now().Format(time.RFC3339),
+		},
+	}
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Created model %s (%d status lines)", input.Name, statusLines)
+	return 0
+}
+
+// List all installed models via /api/tags
+//
+//export list_models
+func list_models(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting model listing")
+
+	var input ListModelsInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	if validationErr := validateOllamaURL(input.OllamaURL); validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return writeError("VALIDATION_ERROR", validationErr.Error(), map[string]interface{}{
+			"error_stage": "validation",
+		})
+	}
+	input.OllamaURL = strings.TrimRight(input.OllamaURL, "/")
+
+	models, err := fetchInstalledModels(input.OllamaURL, newRequestOptions())
+	if err != nil {
+		logError("Failed to list models: %v", err)
+		return writeFetchError(err, "Failed to list models", map[string]interface{}{
+			"error_stage": "http_request",
+			"ollama_url":  input.OllamaURL + "/api/tags",
+		})
+	}
+	if models == nil {
+		models = []ModelInfo{}
+	}
+
+	output := &ModelListOutput{
+		Success: true,
+		Models:  models,
+		Metadata: map[string]interface{}{
+			"model_count":         len(models),
+			"ollama_url":          input.OllamaURL,
+			"processing_complete": true,
+			"timestamp":           time.Now().Format(time.RFC3339),
+		},
+	}
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Listed %d installed models", len(models))
+	return 0
+}
+
+// List installed models matching family, size, quantization and capability
+// filters
+//
+//export list_models_filtered
+func list_models_filtered(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting filtered model listing")
+
+	var input ModelFilterInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	var minParams, maxParams float64
+	validationErr := validateOllamaURL(input.OllamaURL)
+	if validationErr == nil && input.MinParameterSize != "" {
+		minParams, validationErr = parseParameterCount(input.MinParameterSize)
+	}
+	if validationErr == nil && input.MaxParameterSize != "" {
+		maxParams, validationErr = parseParameterCount(input.MaxParameterSize)
+	}
+	if validationErr == nil && maxParams > 0 && minParams > maxParams {
+		validationErr = fmt.Errorf("min_parameter_size cannot exceed max_parameter_size")
+	}
+	if validationErr == nil && input.Capability != "" && !input.FetchDetails {
+		validationErr = fmt.Errorf("capability filter requires fetch_details")
+	}
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return writeError("VALIDATION_ERROR", validationErr.Error(), map[string]interface{}{
+			"error_stage": "validation",
+		})
+	}
+	input.OllamaURL = strings.TrimRight(input.OllamaURL, "/")
+
+	models, err := fetchInstalledModels(input.OllamaURL, newRequestOptions())
+	if err != nil {
+		logError("Failed to list models: %v", err)
+		return writeFetchError(err, "Failed to list models", map[string]interface{}{
+			"error_stage": "http_request",
+			"ollama_url":  input.OllamaURL + "/api/tags",
+		})
+	}
+
+	matched := make([]ModelInfo, 0, len(models))
+	detailFetches, cacheHits := 0, 0
+	for _, model := range models {
+		if !matchesModelFilter(model, &input, minParams, maxParams) {
+			continue
+		}
+		if input.FetchDetails {
+			info, cached, err := fetchModelInfoCached(input.OllamaURL, model, newRequestOptions())
+			if err != nil {
+				logInfo("Skipping %s: failed to fetch details: %v", model.Name, err)
+				continue
+			}
+			if cached {
+				cacheHits++
+			} else {
+				detailFetches++
+			}
+			model.Capabilities = info.Capabilities
+			if input.Capability != "" && !containsFold(info.Capabilities, input.Capability) {
+				continue
+			}
+		}
+		matched = append(matched, model)
+	}
+
+	output := &ModelListOutput{
+		Success: true,
+		Models:  matched,
+		Metadata: map[string]interface{}{
+			"filters": map[string]interface{}{
+				"family":             input.Family,
+				"min_parameter_size": input.MinParameterSize,
+				"max_parameter_size": input.MaxParameterSize,
+				"quantization_level": input.QuantizationLevel,
+				"capability":         input.Capability,
+				"fetch_details":      input.FetchDetails,
+			},
+			"installed_count":     len(models),
+			"match_count":         len(matched),
+			"detail_fetches":      detailFetches,
+			"detail_cache_hits":   cacheHits,
+			"processing_complete": true,
+			"timestamp":           time.Now().Format(time.RFC3339),
+		},
+	}
+
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Matched %d of %d installed models", len(matched), len(models))
+	return 0
+}
+
+// Case-insensitive membership test
+func containsFold(values []string, target string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Summarize where two response texts diverge
+func responseDiffSummary(stored, replayed string) map[string]interface{} {
+	prefix := 0
+	for prefix < len(stored) && prefix < len(replayed) && stored[prefix] == replayed[prefix] {
+		prefix++
+	}
+	summary := map[string]interface{}{
+		"stored_length":        len(stored),
+		"replayed_length":      len(replayed),
+		"common_prefix_length": prefix,
+	}
+	if prefix < len(stored) || prefix < len(replayed) {
+		summary["first_difference_offset"] = prefix
+	}
+	return summary
+}
+
+// Re-run a stored request and compare the new response with the stored one.
+// Requests with a seed are compared on the text; without a seed the output
+// is not deterministic so only the metrics are compared.
+//
+//export replay_request
+func replay_request(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting request replay")
+
+	var input ReplayInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	request := input.Request
+	output := runGeneration(&request)
+	if !output.Success {
+		output.Metadata["error_stage"] = "replay"
+		return writeErrorOutput(output)
+	}
+
+	_, seeded := request.Options["seed"]
+	metadata := output.Metadata
+	metadata["replay_deterministic"] = seeded
+
+	if input.ModelDigest != "" {
+		models, err := fetchInstalledModels(request.OllamaURL, newRequestOptions())
+		if err != nil {
+			logError("Failed to fetch model digest: %v", err)
+			metadata["model_digest_error"] = err.Error()
+		}
+		for _, m := range models {
+			if m.Name == request.Model || strings.TrimSuffix(m.Name, ":latest") == request.Model {
+				metadata["model_digest"] = m.Digest
+				metadata["model_digest_match"] = m.Digest == input.ModelDigest
+				break
+			}
+		}
+	}
+
+	match := output.PromptEvalCount == input.Stored.PromptEvalCount
+	metrics := map[string]interface{}{
+		"stored_prompt_eval_count":   input.Stored.PromptEvalCount,
+		"replayed_prompt_eval_count": output.PromptEvalCount,
+		"stored_eval_count":          input.Stored.EvalCount,
+		"replayed_eval_count":        output.EvalCount,
+		"eval_count_delta":           output.EvalCount - input.Stored.EvalCount,
+	}
+	if seeded {
+		match = match && output.Response == input.Stored.Response && output.EvalCount == input.Stored.EvalCount
+		metadata["replay_compared"] = "text_and_metrics"
+		metadata["replay_diff"] = responseDiffSummary(input.Stored.Response, output.Response)
+	} else {
+		metadata["replay_compared"] = "metrics"
+	}
+	metadata["replay_metrics"] = metrics
+	metadata["replay_match"] = match
+
+	applyResponseEncoding(output, request.ResponseEncoding)
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Replay completed (match: %v)", match)
+	return 0
+}
+
+// 16x16 solid red PNG used by vision_smoke_test
+const visionTestImage = "iVBORw0KGgoAAAANSUhEUgAAABAAAAAQCAIAAACQkWg2AAAAF0lEQVR42mL5z0AaYGIY1TCqYdhqAAwASV4BImdJcyAAAAAASUVORK5CYII="
+
+const visionTestPrompt = "What color is this image? Answer with one word."
+
+// Send a built-in test image to a vision model and check for a plausible
+// answer, exercising image encoding, attachment and model support end to end
+//
+//export vision_smoke_test
+func vision_smoke_test(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting vision smoke test")
+
+	var testInput VisionSmokeTestInput
+	if !readInput(inputPtr, inputLen, &testInput) {
+		return 1
+	}
+
+	input := OllamaInput{
+		Model:     testInput.Model,
+		Prompt:    visionTestPrompt,
+		Images:    []string{visionTestImage},
+		OllamaURL: testInput.OllamaURL,
+		Options:   map[string]interface{}{"temperature": 0.0},
+	}
+	output := runGeneration(&input)
+	if !output.Success {
+		output.Metadata["smoke_test_passed"] = false
+		return writeErrorOutput(output)
+	}
+
+	answer := strings.TrimSpace(output.Response)
+	colorIdentified := strings.Contains(strings.ToLower(answer), "red")
+	passed := answer != ""
+	output.Metadata["smoke_test_passed"] = passed
+	output.Metadata["smoke_test_response"] = answer
+	output.Metadata["smoke_test_prompt"] = visionTestPrompt
+	output.Metadata["expected_color"] = "red"
+	output.Metadata["color_identified"] = colorIdentified
+	if !passed {
+		output.Success = false
+		output.Error = "vision model returned an empty response for the test image"
+		output.ErrorType = "SMOKE_TEST_FAILED"
+		return writeErrorOutput(output)
+	}
+
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Vision smoke test for %s: passed=%v, color identified=%v", input.Model, passed, colorIdentified)
+	if !passed {
+		return 1
+	}
+	return 0
+}
+
+// One line of a line-based diff: ' ' unchanged, '-' removed, '+' added
+type diffLine struct {
+	Kind byte
+	Text string
+	// Zero-based positions in the original and edited texts before this line
+	A, B int
+}
+
+// Split text into lines, ignoring a single trailing newline
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Compute a shortest line edit script with the linear-space variant of
+// Myers' O(ND) algorithm, which keeps two diagonals arrays instead of one
+// per edit distance. Within each changed block removals come before
+// additions.
+func myersDiff(a, b []string) []diffLine {
+	lines := appendDiff(nil, a, b, 0, 0)
+
+	// The recursion can interleave a block's removals and additions;
+	// regroup them, recomputing the positions
+	for start := 0; start < len(lines); {
+		if lines[start].Kind == ' ' {
+			start++
+			continue
+		}
+		end := start
+		var removed, added []string
+		for end < len(lines) && lines[end].Kind != ' ' {
+			if lines[end].Kind == '-' {
+				removed = append(removed, lines[end].Text)
+			} else {
+				added = append(added, lines[end].Text)
+			}
+			end++
+		}
+		a0, b0 := lines[start].A, lines[start].B
+		i := start
+		for n, text := range removed {
+			lines[i] = diffLine{'-', text, a0 + n, b0}
+			i++
+		}
+		for n, text := range added {
+			lines[i] = diffLine{'+', text, a0 + len(removed), b0 + n}
+			i++
+		}
+		start = end
+	}
+	return lines
+}
+
+// Append the edit script turning a into b, whose first lines sit at
+// aStart and bStart of the full texts. Common leading and trailing lines
+// are matched directly and the rest is split at a point on an optimal
+// path found by middleSnake.
+func appendDiff(lines []diffLine, a, b []string, aStart, bStart int) []diffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		lines = append(lines, diffLine{' ', a[prefix], aStart + prefix, bStart + prefix})
+		prefix++
+	}
+	a, b = a[prefix:], b[prefix:]
+	aStart, bStart = aStart+prefix, bStart+prefix
+
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	common := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	if x, y := middleSnake(a, b); x >= 0 {
+		lines = appendDiff(lines, a[:x], b[:y], aStart, bStart)
+		lines = appendDiff(lines, a[x:], b[y:], aStart+x, bStart+y)
+	} else {
+		for i, line := range a {
+			lines = append(lines, diffLine{'-', line, aStart + i, bStart})
+		}
+		for i, line := range b {
+			lines = append(lines, diffLine{'+', line, aStart + len(a), bStart + i})
+		}
+	}
+
+	for i, line := range common {
+		lines = append(lines, diffLine{' ', line, aStart + len(a) + i, bStart + len(b) + i})
+	}
+	return lines
+}
+
+// Find where the forward and reverse searches for a shortest edit path
+// between a and b meet, returning a split point on such a path. Once
+// appendDiff has stripped the common ends the point always divides the
+// problem. Returns -1, -1 when either side is empty or the searches do not
+// meet, leaving the caller to replace a with b.
+func middleSnake(a, b []string) (int, int) {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return -1, -1
+	}
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	size := 2*maxD + 2
+	forward := make([]int, size)
+	reverse := make([]int, size)
+	for i := range forward {
+		forward[i] = -1
+		reverse[i] = -1
+	}
+	forward[offset+1] = 0
+	reverse[offset+1] = 0
+
+	// With an odd delta the paths meet during a forward step, otherwise
+	// during a reverse one. Diagonals that ran off the edit graph are
+	// trimmed from the ends of the next rounds.
+	delta := n - m
+	odd := delta%2 != 0
+	fStart, fEnd, rStart, rEnd := 0, 0, 0, 0
+	for d := 0; d < maxD; d++ {
+		for k := -d + fStart; k <= d-fEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			switch {
+			case x > n:
+				fEnd += 2
+			case y > m:
+				fStart += 2
+			case odd:
+				rk := offset + delta - k
+				if rk >= 0 && rk < size && reverse[rk] != -1 && x >= n-reverse[rk] {
+					return x, y
+				}
+			}
+		}
+		for k := -d + rStart; k <= d-rEnd; k += 2 {
+			var x int
+			if k == -d || (k != d && reverse[offset+k-1] < reverse[offset+k+1]) {
+				x = reverse[offset+k+1]
+			} else {
+				x = reverse[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			reverse[offset+k] = x
+			switch {
+			case x > n:
+				rEnd += 2
+			case y > m:
+				rStart += 2
+			case !odd:
+				fk := offset + delta - k
+				if fk >= 0 && fk < size && forward[fk] != -1 {
+					fx := forward[fk]
+					if fx >= n-x {
+						return fx, offset + fx - fk
+					}
+				}
+			}
+		}
+	}
+	return -1, -1
+}
+
+// Format a range for a unified diff hunk header
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// Render a unified diff with the given number of context lines
+func unifiedDiff(lines []diffLine, fromName, toName string, context int) string {
+	var changes []int
+	for i, line := range lines {
+		if line.Kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+	for c := 0; c < len(changes); {
+		// Merge changes whose context would overlap into one hunk
+		first, last := changes[c], changes[c]
+		c++
+		for c < len(changes) && changes[c]-last <= 2*context {
+			last = changes[c]
+			c++
+		}
+		start := first - context
+		if start < 0 {
+			start = 0
+		}
+		end := last + context + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		aCount, bCount := 0, 0
+		for _, line := range lines[start:end] {
+			if line.Kind != '+' {
+				aCount++
+			}
+			if line.Kind != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(lines[start].A, aCount), hunkRange(lines[start].B, bCount))
+		for _, line := range lines[start:end] {
+			sb.WriteByte(line.Kind)
+			sb.WriteString(line.Text)
+			sb.WriteByte('\n')
+		}
+	}
+	return sb.String()
+}
+
+const editDocumentSystem = "You are a careful editor. Apply the instruction to the document and " +
+	"reply with the complete edited document only, without commentary or code fences."
+
+// Ask the model to edit a document and return the edited text with a
+// unified diff against the original
+//
+//export edit_document
+func edit_document(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting document edit")
+
+	var editInput EditDocumentInput
+	if !readInput(inputPtr, inputLen, &editInput) {
+		return 1
+	}
+
+	var validationErr error
+	switch {
+	case strings.TrimSpace(editInput.Original) == "":
+		validationErr = fmt.Errorf("original field is required")
+	case strings.TrimSpace(editInput.Instruction) == "":
+		validationErr = fmt.Errorf("instruction field is required")
+	}
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return writeError("VALIDATION_ERROR", validationErr.Error(), map[string]interface{}{
+			"error_stage": "validation",
+			"model":       editInput.Model,
+		})
+	}
+
+	input := OllamaInput{
+		Model:     editInput.Model,
+		System:    editDocumentSystem,
+		Prompt:    fmt.Sprintf("Instruction:\n%s\n\nDocument:\n%s", editInput.Instruction, editInput.Original),
+		OllamaURL: editInput.OllamaURL,
+		Options:   editInput.Options,
+		KeepAlive: editInput.KeepAlive,
+	}
+	generated := runGeneration(&input)
+	if !generated.Success {
+		return writeErrorOutput(generated)
+	}
+
+	edited := generated.Response
+	lines := myersDiff(splitLines(editInput.Original), splitLines(edited))
+	added, removed := 0, 0
+	for _, line := range lines {
+		switch line.Kind {
+		case '+':
+			added++
+		case '-':
+			removed++
+		}
+	}
+
+	metadata := generated.Metadata
+	metadata["lines_added"] = added
+	metadata["lines_removed"] = removed
+	metadata["changed_lines"] = added + removed
+	metadata["original_lines"] = len(splitLines(editInput.Original))
+	metadata["edited_lines"] = len(splitLines(edited))
+
+	output := &EditDocumentOutput{
+		Success:    true,
+		Model:      generated.Model,
+		EditedText: edited,
+		Diff:       unifiedDiff(lines, "original", "edited", 3),
+		Metadata:   metadata,
+	}
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Document edited: %d lines added, %d removed", added, removed)
+	return 0
+}
+
+// Fixed prompt and options so cold and warm runs are comparable
+const latencyProfilePrompt = "Reply with the single word: ready"
+
+// Server-reported timings of one profiling run, in nanoseconds
+func runTimings(output *OllamaOutput) map[string]interface{} {
+	return map[string]interface{}{
+		"total_duration":       output.TotalDuration,
+		"load_duration":        output.LoadDuration,
+		"prompt_eval_duration": output.PromptEvalDuration,
+		"eval_duration":        output.EvalDuration,
+		"eval_count":           output.EvalCount,
+	}
+}
+
+// Measure the cold-start penalty of a model: unload it, time a cold
+// generation, then time an identical warm generation
+//
+//export latency_profile
+func latency_profile(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting latency profile")
+
+	var profileInput LatencyProfileInput
+	if !readInput(inputPtr, inputLen, &profileInput) {
+		return 1
+	}
+
+	validationErr := validateOllamaURL(profileInput.OllamaURL)
+	if validationErr == nil && profileInput.Model == "" {
+		validationErr = fmt.Errorf("model field is required")
+	}
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return writeError("VALIDATION_ERROR", validationErr.Error(), map[string]interface{}{
+			"error_stage": "validation",
+			"model":       profileInput.Model,
+		})
+	}
+	baseURL := strings.TrimRight(profileInput.OllamaURL, "/")
+
+	if err := unloadModel(baseURL, profileInput.Model, newRequestOptions()); err != nil {
+		logError("Failed to unload model: %v", err)
+		return writeFetchError(err, "Failed to unload model before cold run", map[string]interface{}{
+			"error_stage": "unload",
+			"ollama_url":  baseURL,
+			"model":       profileInput.Model,
+		})
+	}
+
+	newRun := func() *OllamaInput {
+		return &OllamaInput{
+			Model:     profileInput.Model,
+			Prompt:    latencyProfilePrompt,
+			OllamaURL: baseURL,
+			Options:   map[string]interface{}{"temperature": 0.0, "seed": 0.0, "num_predict": 8.0},
+		}
+	}
+
+	logInfo("Running cold generation")
+	cold := runGeneration(newRun())
+	if !cold.Success {
+		cold.Metadata["error_stage"] = "cold_run"
+		return writeErrorOutput(cold)
+	}
+
+	logInfo("Running warm generation")
+	warm := runGeneration(newRun())
+	if !warm.Success {
+		warm.Metadata["error_stage"] = "warm_run"
+		return writeErrorOutput(warm)
+	}
+
+	output := &LatencyProfileOutput{
+		Success: true,
+		Model:   profileInput.Model,
+		Metadata: map[string]interface{}{
+			"cold":                  runTimings(cold),
+			"warm":                  runTimings(warm),
+			"total_duration_delta":  cold.TotalDuration - warm.TotalDuration,
+			"load_duration_delta":   cold.LoadDuration - warm.LoadDuration,
+			"cold_start_penalty_ms": float64(cold.TotalDuration-warm.TotalDuration) / 1e6,
+			"prompt":                latencyProfilePrompt,
+			"ollama_url":            baseURL,
+			"processing_complete":   true,
+			"timestamp":             time.Now().Format(time.RFC3339),
+		},
+	}
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Cold start penalty for %s: %d ns", profileInput.Model, cold.TotalDuration-warm.TotalDuration)
+	return 0
+}
+
+// Successful output describing a prepared request without sending it
+func resolvedRequestOutput(input *OllamaInput, prepared *preparedGeneration) *OllamaOutput {
+	metadata := buildMetadata(input, 0)
+	metadata["resolved_url"] = prepared.URL
+	metadata["resolved_request"] = prepared.Request
+	metadata["request_bytes"] = len(prepared.Body)
+	addPreparationMetadata(metadata, prepared, input)
+
+	return &OllamaOutput{
+		Success:  true,
+		Model:    input.Model,
+		Done:     true,
+		Metadata: metadata,
+	}
+}
+
+// Resolve an input into the exact /api/generate request that
+// generate_ollama would send, without sending it
+//
+//export resolve_config
+func resolve_config(inputPtr, inputLen uint32) uint32 {
+	logInfo("Resolving effective request configuration")
+
+	var input OllamaInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	prepared, failed := prepareGeneration(&input)
+	if failed != nil {
+		return writeErrorOutput(failed)
+	}
+
+	output := resolvedRequestOutput(&input, prepared)
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Resolved request configuration")
+	return 0
+}
+
+const defaultWarmKeepAlive = "10m"
+
+// Load each model in turn with a keep_alive, then confirm via /api/ps that
+// all of them are still resident. WASM is single-threaded, so loads run
+// sequentially; a model evicted by a later load shows up as not ready.
+//
+//export warm_models
+func warm_models(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting model warm-up")
+
+	var input WarmModelsInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	validationErr := validateOllamaURL(input.OllamaURL)
+	if validationErr == nil && len(input.Models) == 0 {
+		validationErr = fmt.Errorf("models must contain at least one model")
+	}
+	for i, model := range input.Models {
+		if validationErr == nil && strings.TrimSpace(model) == "" {
+			validationErr = fmt.Errorf("models[%d] must not be empty", i)
+		}
+	}
+	keepAlive := input.KeepAlive
+	if keepAlive == "" {
+		keepAlive = defaultWarmKeepAlive
+	}
+	keepAliveSeconds := 0.0
+	if validationErr == nil {
+		keepAlive, keepAliveSeconds, validationErr = parseKeepAlive(keepAlive)
+	}
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return writeError("VALIDATION_ERROR", validationErr.Error(), map[string]interface{}{
+			"error_stage": "validation",
+		})
+	}
+	baseURL := strings.TrimRight(input.OllamaURL, "/")
+
+	loadDurations := make(map[string]int64)
+	loadErrors := make(map[string]string)
+	loadErrorTypes := make(map[string]string)
+	for _, model := range input.Models {
+		logInfo("Loading model %s", model)
+		response, err := setModelKeepAlive(baseURL, model, keepAlive, newRequestOptions())
+		if err != nil {
+			logError("Failed to load %s: %v", model, err)
+			failure := httpRequestErrorOutput(err, map[string]interface{}{}, "")
+			loadErrors[model] = failure.Error
+			loadErrorTypes[model] = failure.ErrorType
+			continue
+		}
+		loadDurations[model] = response.LoadDuration
+	}
+
+	running, err := fetchRunningModels(baseURL, newRequestOptions())
+	if err != nil {
+		logError("Failed to list running models: %v", err)
+		return writeFetchError(err, "Failed to verify loaded models", map[string]interface{}{
+			"error_stage":      "residency_check",
+			"ollama_url":       baseURL + "/api/ps",
+			"load_durations":   loadDurations,
+			"load_errors":      loadErrors,
+			"load_error_types": loadErrorTypes,
+		})
+	}
+
+	ready := make(map[string]bool, len(input.Models))
+	var notResident []string
+	for _, model := range input.Models {
+		resident := false
+		for _, m := range running {
+			if m.Name == model || m.Model == model || strings.TrimSuffix(m.Name, ":latest") == model {
+				resident = true
+				break
+			}
+		}
+		ready[model] = resident
+		if !resident {
+			if _, failed := loadErrors[model]; !failed {
+				notResident = append(notResident, model)
+			}
+		}
+	}
+
+	output := &WarmModelsOutput{
+		Success: len(loadErrors) == 0 && len(notResident) == 0,
+		Ready:   ready,
+		Metadata: map[string]interface{}{
+			"load_durations":      loadDurations,
+			"load_errors":         loadErrors,
+			"load_error_types":    loadErrorTypes,
+			"not_resident":        notResident,
+			"keep_alive":          keepAlive,
+			"keep_alive_seconds":  keepAliveSeconds,
+			"resident_models":     len(running),
+			"ollama_url":          baseURL,
+			"processing_complete": true,
+			"timestamp":           time.Now().Format(time.RFC3339),
+		},
+	}
+	if !output.Success {
+		output.Error = fmt.Sprintf("%d of %d models are not ready", len(loadErrors)+len(notResident), len(input.Models))
+		output.ErrorType = "MODELS_NOT_READY"
+		return writeErrorOutput(output)
+	}
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Warm-up complete: %d of %d models ready", len(input.Models), len(input.Models))
+	return 0
+}
+
+// Embed one text via /api/embeddings
+func fetchEmbedding(baseURL string, request EmbeddingsAPIRequest, opts *httpRequestOptions) ([]float64, error) {
+	requestBody, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	responseBody, err := makeHttpRequest(baseURL+"/api/embeddings", "POST", string(requestBody), opts)
+	if err != nil {
+		return nil, err
+	}
+	var response EmbeddingsAPIResponse
+	if err := json.Unmarshal([]byte(responseBody), &response); err != nil {
+		return nil, fmt.Errorf("invalid /api/embeddings response: %v", err)
+	}
+	if len(response.Embedding) == 0 {
+		return nil, fmt.Errorf("/api/embeddings returned an empty embedding")
+	}
+	return response.Embedding, nil
+}
+
+// Embed a prompt, or each text of a batch, via /api/embeddings. The
+// endpoint takes one prompt per call, so a batch makes one call per text.
+//
+//export generate_embeddings
+func generate_embeddings(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting embedding generation")
+
+	var input EmbeddingsInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	batch := len(input.Input) > 0
+	var validationErr error
+	switch {
+	case input.Model == "":
+		validationErr = fmt.Errorf("model field is required")
+	case batch && input.Prompt != "":
+		validationErr = fmt.Errorf("prompt and input cannot both be set")
+	case !batch && strings.TrimSpace(input.Prompt) == "":
+		validationErr = fmt.Errorf("prompt or input is required")
+	default:
+		validationErr = validateOllamaURL(input.OllamaURL)
+	}
+	for i, text := range input.Input {
+		if validationErr == nil && strings.TrimSpace(text) == "" {
+			validationErr = fmt.Errorf("input[%d] must not be empty", i)
+		}
+	}
+	if validationErr == nil {
+		validationErr = validateOptions(input.Options)
+	}
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return writeError("VALIDATION_ERROR", validationErr.Error(), map[string]interface{}{
+			"error_stage": "validation",
+			"model":       input.Model,
+		})
+	}
+
+	texts := input.Input
+	if !batch {
+		texts = []string{input.Prompt}
+	}
+
+	baseURL := strings.TrimRight(input.OllamaURL, "/")
+	started := time.Now()
+	embeddings := make([][]float64, 0, len(texts))
+	for i, text := range texts {
+		embedding, err := fetchEmbedding(baseURL, EmbeddingsAPIRequest{
+			Model:     input.Model,
+			Prompt:    text,
+			Options:   input.Options,
+			KeepAlive: input.KeepAlive,
+		}, newRequestOptions())
+		if err == nil && len(embeddings) > 0 && len(embedding) != len(embeddings[0]) {
+			err = fmt.Errorf("embedding dimension %d differs from %d", len(embedding), len(embeddings[0]))
+		}
+		if err != nil {
+			logError("Embedding %d failed: %v", i, err)
+			metadata := map[string]interface{}{
+				"error_stage": "embedding",
+				"ollama_url":  baseURL + "/api/embeddings",
 				"model":       input.Model,
-			},
-		)
-		writeOutputFile(output)
+				"input_index": i,
+			}
+			if _, ok := err.(*httpStatusError); ok {
+				return writeErrorOutput(httpRequestErrorOutput(err, metadata, ""))
+			}
+			return writeError("EMBEDDING_ERROR", fmt.Sprintf("Failed to embed input %d: %v", i, err), metadata)
+		}
+		embeddings = append(embeddings, embedding)
+	}
+
+	output := &EmbeddingsOutput{
+		Success: true,
+		Model:   input.Model,
+		Metadata: map[string]interface{}{
+			"dimension":           len(embeddings[0]),
+			"input_count":         len(embeddings),
+			"total_duration":      time.Since(started).Nanoseconds(),
+			"ollama_url":          baseURL,
+			"processing_complete": true,
+			"timestamp":           time.Now().Format(time.RFC3339),
+		},
+	}
+	if batch {
+		output.Embeddings = embeddings
+	} else {
+		output.Embedding = embeddings[0]
+	}
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
 		return 1
 	}
 
-	logToFloat("HTTP request completed successfully")
+	logInfo("Generated %d embeddings of dimension %d", len(embeddings), len(embeddings[0]))
+	return 0
+}
 
-	// Parse Ollama response
-	var apiResponse OllamaAPIResponse
-	if err := json.Unmarshal([]byte(responseBody), &apiResponse); err != nil {
-		logToFloat(fmt.Sprintf("Failed to parse Ollama response: %v", err))
-		output := createErrorOutput(
-			fmt.Sprintf("Invalid response from Ollama server: %v", err),
-			"RESPONSE_PARSE_ERROR",
+// Embed texts with a single /api/embed call
+func fetchEmbeddings(baseURL, model string, texts []string, keepAlive string, opts *httpRequestOptions) (*EmbedAPIResponse, error) {
+	requestBody, err := json.Marshal(EmbedAPIRequest{Model: model, Input: texts, KeepAlive: keepAlive})
+	if err != nil {
+		return nil, err
+	}
+	responseBody, err := makeHttpRequest(baseURL+"/api/embed", "POST", string(requestBody), opts)
+	if err != nil {
+		return nil, err
+	}
+	var response EmbedAPIResponse
+	if err := json.Unmarshal([]byte(responseBody), &response); err != nil {
+		return nil, fmt.Errorf("invalid /api/embed response: %v", err)
+	}
+	return &response, nil
+}
+
+// Cosine similarity of two vectors of equal dimension
+func cosineSimilarity(a, b []float64) (float64, error) {
+	if len(a) != len(b) {
+		return 0, fmt.Errorf("embedding dimensions differ (%d vs %d)", len(a), len(b))
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0, fmt.Errorf("cannot compare a zero-length embedding")
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB)), nil
+}
+
+// Embed two texts (or a batch of pairs) with one model and return their
+// cosine similarity. Vectors are only returned with include_vectors.
+//
+//export text_similarity
+func text_similarity(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting text similarity")
+
+	var input TextSimilarityInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	pairs := input.Pairs
+	batch := len(pairs) > 0
+	var validationErr error
+	switch {
+	case input.Model == "":
+		validationErr = fmt.Errorf("model field is required")
+	case batch && (input.TextA != "" || input.TextB != ""):
+		validationErr = fmt.Errorf("text_a/text_b and pairs cannot both be set")
+	case !batch && (strings.TrimSpace(input.TextA) == "" || strings.TrimSpace(input.TextB) == ""):
+		validationErr = fmt.Errorf("text_a and text_b fields are required")
+	default:
+		validationErr = validateOllamaURL(input.OllamaURL)
+	}
+	for i, pair := range pairs {
+		if validationErr == nil && (strings.TrimSpace(pair.A) == "" || strings.TrimSpace(pair.B) == "") {
+			validationErr = fmt.Errorf("pairs[%d] must have both a and b", i)
+		}
+	}
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return writeError("VALIDATION_ERROR", validationErr.Error(), map[string]interface{}{
+			"error_stage": "validation",
+			"model":       input.Model,
+		})
+	}
+	if !batch {
+		pairs = []TextPair{{A: input.TextA, B: input.TextB}}
+	}
+
+	texts := make([]string, 0, 2*len(pairs))
+	for _, pair := range pairs {
+		texts = append(texts, pair.A, pair.B)
+	}
+
+	baseURL := strings.TrimRight(input.OllamaURL, "/")
+	logInfo("Embedding %d texts with %s", len(texts), input.Model)
+	response, err := fetchEmbeddings(baseURL, input.Model, texts, input.KeepAlive, newRequestOptions())
+	if err != nil {
+		logError("Embedding request failed: %v", err)
+		return writeFetchError(err, "Failed to embed texts", map[string]interface{}{
+			"error_stage": "http_request",
+			"ollama_url":  baseURL + "/api/embed",
+			"model":       input.Model,
+		})
+	}
+	if len(response.Embeddings) != len(texts) {
+		logError("Expected %d embeddings, got %d", len(texts), len(response.Embeddings))
+		return writeError(
+			"EMBEDDING_ERROR",
+			fmt.Sprintf("Expected %d embeddings, got %d; is %s an embedding model?", len(texts), len(response.Embeddings), input.Model),
 			map[string]interface{}{
-				"error_stage":     "response_parsing",
-				"raw_response":    responseBody,
-				"response_length": len(responseBody),
+				"error_stage": "response_parsing",
+				"model":       input.Model,
 			},
 		)
-		writeOutputFile(output)
+	}
+
+	similarities := make([]float64, len(pairs))
+	for i := range pairs {
+		similarity, err := cosineSimilarity(response.Embeddings[2*i], response.Embeddings[2*i+1])
+		if err != nil {
+			logError("Similarity failed for pair %d: %v", i, err)
+			return writeError("EMBEDDING_ERROR", err.Error(), map[string]interface{}{
+				"error_stage": "similarity",
+				"model":       input.Model,
+				"pair_index":  i,
+			})
+		}
+		similarities[i] = similarity
+	}
+
+	output := &TextSimilarityOutput{
+		Success: true,
+		Model:   input.Model,
+		Metadata: map[string]interface{}{
+			"dimension":           len(response.Embeddings[0]),
+			"pair_count":          len(pairs),
+			"total_duration":      response.TotalDuration,
+			"ollama_url":          baseURL,
+			"processing_complete": true,
+			"timestamp":           time.Now().Format(time.RFC3339),
+		},
+	}
+	if batch {
+		output.Similarities = similarities
+	} else {
+		output.Similarity = &similarities[0]
+		output.Metadata["similarity"] = similarities[0]
+	}
+	if input.IncludeVectors {
+		output.Vectors = response.Embeddings
+	}
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
 		return 1
 	}
 
-	logToFloat(fmt.Sprintf("Successfully parsed Ollama response (%d characters)", len(apiResponse.Response)))
+	logInfo("Compared %d text pairs", len(pairs))
+	return 0
+}
 
-	// Build successful output
-	output := &OllamaOutput{
-		Success:            true,
-		Response:           apiResponse.Response,
-		Model:              apiResponse.Model,
-		CreatedAt:          apiResponse.CreatedAt,
-		Done:               apiResponse.Done,
-		Context:            apiResponse.Context,
-		TotalDuration:      apiResponse.TotalDuration,
-		LoadDuration:       apiResponse.LoadDuration,
-		PromptEvalCount:    apiResponse.PromptEvalCount,
-		PromptEvalDuration: apiResponse.PromptEvalDuration,
-		EvalCount:          apiResponse.EvalCount,
-		EvalDuration:       apiResponse.EvalDuration,
-		Metadata:           buildMetadata(&input, len(apiResponse.Response)),
+// Oldest Ollama release supporting each named feature
+var featureMinVersions = map[string]string{
+	"api_ps":             "0.1.38",
+	"api_embed":          "0.3.0",
+	"tools":              "0.3.0",
+	"structured_outputs": "0.5.0",
+	"capabilities":       "0.6.4",
+	"think":              "0.9.0",
+}
+
+// Fetch the server version via /api/version
+func fetchServerVersion(baseURL string, opts *httpRequestOptions) (string, error) {
+	responseBody, err := makeHttpRequest(baseURL+"/api/version", "GET", "", opts)
+	if err != nil {
+		return "", err
+	}
+	return decodeVersionResponse(responseBody)
+}
+
+// Extract the version from an /api/version response body
+func decodeVersionResponse(responseBody string) (string, error) {
+	var response VersionAPIResponse
+	if err := json.Unmarshal([]byte(responseBody), &response); err != nil {
+		return "", fmt.Errorf("invalid /api/version response: %v", err)
 	}
+	if response.Version == "" {
+		return "", fmt.Errorf("/api/version returned no version")
+	}
+	return response.Version, nil
+}
 
-	// Write output file
+// Parse "v0.5.7" or "0.6.0-rc1" into its numeric major, minor and patch
+// parts; pre-release and build suffixes are ignored
+func parseVersion(version string) ([3]int, error) {
+	var parts [3]int
+	core := strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if i := strings.IndexAny(core, "-+"); i >= 0 {
+		core = core[:i]
+	}
+	fields := strings.Split(core, ".")
+	if len(fields) == 0 || len(fields) > 3 {
+		return parts, fmt.Errorf("invalid version %q", version)
+	}
+	for i, field := range fields {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 {
+			return parts, fmt.Errorf("invalid version %q", version)
+		}
+		parts[i] = n
+	}
+	return parts, nil
+}
+
+// Compare two parsed versions, returning -1, 0 or 1
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// Check the server version against the minimum for a feature, so
+// workflows can gate behavior before hitting a cryptic failure
+//
+//export require_version
+func require_version(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting server version check")
+
+	var input RequireVersionInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	required := input.MinVersion
+	validationErr := validateOllamaURL(input.OllamaURL)
+	if validationErr == nil && required == "" {
+		if input.Feature == "" {
+			validationErr = fmt.Errorf("feature or min_version is required")
+		} else if minVersion, ok := featureMinVersions[input.Feature]; ok {
+			required = minVersion
+		} else {
+			known := make([]string, 0, len(featureMinVersions))
+			for feature := range featureMinVersions {
+				known = append(known, feature)
+			}
+			sort.Strings(known)
+			validationErr = fmt.Errorf("unknown feature %q (known: %s)", input.Feature, strings.Join(known, ", "))
+		}
+	}
+	var requiredParts [3]int
+	if validationErr == nil {
+		requiredParts, validationErr = parseVersion(required)
+	}
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return writeError("VALIDATION_ERROR", validationErr.Error(), map[string]interface{}{
+			"error_stage": "validation",
+		})
+	}
+
+	baseURL := strings.TrimRight(input.OllamaURL, "/")
+	serverVersion, err := fetchServerVersion(baseURL, newRequestOptions())
+	var serverParts [3]int
+	if err == nil {
+		serverParts, err = parseVersion(serverVersion)
+	}
+	if err != nil {
+		logError("Failed to get server version: %v", err)
+		return writeFetchError(err, "Failed to get server version", map[string]interface{}{
+			"error_stage": "http_request",
+			"ollama_url":  baseURL + "/api/version",
+		})
+	}
+
+	supported := compareVersions(serverParts, requiredParts) >= 0
+	output := &RequireVersionOutput{
+		Success:   true,
+		Supported: supported,
+		Metadata: map[string]interface{}{
+			"server_version":      serverVersion,
+			"required_version":    required,
+			"supported":           supported,
+			"ollama_url":          baseURL,
+			"processing_complete": true,
+			"timestamp":           time.Now().Format(time.RFC3339),
+		},
+	}
+	if input.Feature != "" {
+		output.Metadata["feature"] = input.Feature
+	}
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Server %s, required %s, supported: %t", serverVersion, required, supported)
+	return 0
+}
+
+// Check that the server is alive and report its version. A server that
+// cannot be reached still gets an output, with reachable false.
+//
+//export check_server
+func check_server(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting server health check")
+
+	var input CheckServerInput
+	if !readInput(inputPtr, inputLen, &input) {
+		return 1
+	}
+
+	validationErr := validateOllamaURL(input.OllamaURL)
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return writeError("VALIDATION_ERROR", validationErr.Error(), map[string]interface{}{
+			"error_stage": "validation",
+		})
+	}
+
+	baseURL := strings.TrimRight(input.OllamaURL, "/")
+	output := &CheckServerOutput{
+		Metadata: map[string]interface{}{
+			"ollama_url":          baseURL,
+			"processing_complete": true,
+			"timestamp":           time.Now().Format(time.RFC3339),
+		},
+	}
+
+	responseBody, err := makeHttpRequest(baseURL+"/api/version", "GET", "", newRequestOptions())
+	if err != nil {
+		logError("Server unreachable: %v", err)
+		output.Error = fmt.Sprintf("Server unreachable: %v", err)
+		output.ErrorType = "SERVER_UNREACHABLE"
+		output.Metadata["error_stage"] = "http_request"
+		if statusErr, ok := err.(*httpStatusError); ok {
+			output.Metadata["status_code"] = statusErr.Status
+		}
+		return writeErrorOutput(output)
+	}
+
+	output.Reachable = true
+	version, err := decodeVersionResponse(responseBody)
+	if err != nil {
+		logError("Failed to parse server version: %v", err)
+		output.Error = err.Error()
+		output.ErrorType = "RESPONSE_PARSE_ERROR"
+		output.Metadata["error_stage"] = "response_parsing"
+		return writeErrorOutput(output)
+	}
+
+	output.Success = true
+	output.Version = version
 	if writeErr := writeOutputFile(output); writeErr != nil {
-		logToFloat(fmt.Sprintf("Failed to write output file: %v", writeErr))
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
+
+	logInfo("Server reachable, version %s", version)
+	return 0
+}
+
+// Ollama's template when a model defines none
+const defaultModelTemplate = "{{ .Prompt }}"
+
+// Render a model template the way the server does: System and Prompt are
+// set directly and also appended to Messages when not already present.
+// Values are passed as maps so fields the module does not model (tools,
+// thinking) evaluate as empty instead of failing.
+func renderModelTemplate(text, system, prompt string, messages []ChatMessage) (string, error) {
+	if strings.TrimSpace(text) == "" {
+		text = defaultModelTemplate
+	}
+	tmpl, err := template.New("model").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse model template: %v", err)
+	}
+
+	hasSystem := false
+	for _, message := range messages {
+		if message.Role == "system" {
+			hasSystem = true
+		}
+	}
+	var turns []map[string]interface{}
+	if system != "" && !hasSystem {
+		turns = append(turns, map[string]interface{}{"Role": "system", "Content": system})
+	}
+	for _, message := range messages {
+		turns = append(turns, map[string]interface{}{"Role": message.Role, "Content": message.Content})
+	}
+	if prompt != "" {
+		turns = append(turns, map[string]interface{}{"Role": "user", "Content": prompt})
+	}
+
+	// Templates that predate .Messages only see .System and .Prompt, so
+	// fill them from the last system and user turns when not given
+	hasSystemPrompt, hasUserPrompt := system != "", prompt != ""
+	for _, message := range messages {
+		if message.Role == "system" && !hasSystemPrompt {
+			system = message.Content
+		}
+		if message.Role == "user" && !hasUserPrompt {
+			prompt = message.Content
+		}
+	}
+
+	var rendered strings.Builder
+	err = tmpl.Execute(&rendered, map[string]interface{}{
+		"System":   system,
+		"Prompt":   prompt,
+		"Response": "",
+		"Messages": turns,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to render model template: %v", err)
+	}
+	return rendered.String(), nil
+}
+
+// Render system, prompt and messages through the model's template so the
+// result can be sent with raw: true, bypassing server-side templating
+//
+//export prepare_raw_prompt
+func prepare_raw_prompt(inputPtr, inputLen uint32) uint32 {
+	logInfo("Starting raw prompt preparation")
+
+	var input PrepareRawPromptInput
+	if !readInput(inputPtr, inputLen, &input) {
 		return 1
 	}
 
-	logToFloat("Ollama text generation completed successfully")
-	logToFloat(fmt.Sprintf("Generated %d characters in response", len(apiResponse.Response)))
+	var validationErr error
+	switch {
+	case input.Model == "":
+		validationErr = fmt.Errorf("model field is required")
+	case input.Prompt == "" && len(input.Messages) == 0:
+		validationErr = fmt.Errorf("prompt or messages is required")
+	default:
+		validationErr = validateOllamaURL(input.OllamaURL)
+	}
+	if validationErr == nil {
+		validationErr = validateChatMessages(input.Messages)
+	}
+	if validationErr != nil {
+		logError("Input validation failed: %v", validationErr)
+		return writeError("VALIDATION_ERROR", validationErr.Error(), map[string]interface{}{
+			"error_stage": "validation",
+			"model":       input.Model,
+		})
+	}
+
+	baseURL := strings.TrimRight(input.OllamaURL, "/")
+	info, err := fetchModelInfo(baseURL, input.Model, newRequestOptions())
+	if err != nil {
+		logError("Failed to fetch model template: %v", err)
+		return writeFetchError(err, "Failed to fetch model template", map[string]interface{}{
+			"error_stage": "http_request",
+			"ollama_url":  baseURL + "/api/show",
+			"model":       input.Model,
+		})
+	}
+
+	rendered, err := renderModelTemplate(info.Template, input.System, input.Prompt, input.Messages)
+	if err != nil {
+		logError("Template rendering failed: %v", err)
+		return writeError("TEMPLATE_ERROR", err.Error(), map[string]interface{}{
+			"error_stage": "template_rendering",
+			"model":       input.Model,
+		})
+	}
+
+	output := &PrepareRawPromptOutput{
+		Success: true,
+		Model:   input.Model,
+		Prompt:  rendered,
+		Metadata: map[string]interface{}{
+			"rendered_length":     len(rendered),
+			"template_length":     len(info.Template),
+			"default_template":    strings.TrimSpace(info.Template) == "",
+			"message_count":       len(input.Messages),
+			"ollama_url":          baseURL,
+			"processing_complete": true,
+			"timestamp":           time.Now().Format(time.RFC3339),
+		},
+	}
+	if writeErr := writeOutputFile(output); writeErr != nil {
+		logError("Failed to write output file: %v", writeErr)
+		return 1
+	}
 
+	logInfo("Rendered raw prompt (%d characters)", len(rendered))
 	return 0
 }
 